@@ -1,40 +1,437 @@
 const fs = require('fs');
 const http = require('http');
-const net = require('net');
+const https = require('https');
 const path = require('path');
 const systemdSocket = require('systemd-socket');
 const url = require('url');
+const zlib = require('zlib');
 const { execFileSync } = require('child_process');
-const { program } = require('commander');
+const { pipeline } = require('stream');
+const { pipeline: pipelineAsync } = require('stream/promises');
+const { program, Option } = require('commander');
+const { defaultConfigPath, loadConfig } = require('./lib/config');
+const { compilePathRules, applyPathRules } = require('./lib/path-rules');
+const {
+  compileDriveMappings,
+  mapDrivePath,
+  compileShareMappings,
+  getShare,
+  mapSharePath,
+} = require('./lib/drive-mappings');
+const { compileMountPolicy, checkMountPolicy } = require('./lib/mount-policy');
+const { compileApiPolicy, getApiPolicyViolation, getReadOnlyViolation } = require('./lib/api-policy');
+const { getPeerCredentials } = require('./lib/peer-cred');
+const { getUserName, getUserGid, resolveUid, resolveGid } = require('./lib/passwd');
+const { ProxyError, MountDeniedError } = require('./lib/errors');
+const {
+  translationFailureModes,
+  compileTranslationFailureModes,
+  getTranslationFailureMode,
+} = require('./lib/translation-failure');
+const { readMountInfo, getMountForPath } = require('./lib/mountinfo');
+const { TranslationStats } = require('./lib/translation-stats');
+const { compileCreateHooks, CreateHookRunner } = require('./lib/create-hooks');
+const { BodySizeLimit, checkContentLength } = require('./lib/body-limit');
+const { getLifecycleEvent, compileWebhooks, notifyWebhooks } = require('./lib/webhooks');
+const { isSubpath, normalizePath, resolveRealPath, expandPlaceholders } = require('./lib/paths');
+const {
+  automountRoot,
+  isWindowsMount,
+  getWindowsPath,
+  parseWindowsDrivePath,
+  getDrivePath,
+  translateAll,
+  PathCache,
+} = require('./lib/wslpath');
+const { isUnshareableFilesystem, copyDirectoryToVolume, createScratchVolume } = require('./lib/volumes');
+const {
+  upstreamAgent,
+  hopByHopHeaders,
+  parseUpstreamAddress,
+  setConnectTimeout,
+  connectUpstream,
+  pingUpstream,
+} = require('./lib/upstream');
+const { JsonRewriter, canonicalizeKeys } = require('./lib/json-stream');
+const { ContainerTracker, EventStreamRewriter } = require('./lib/event-stream');
+const { EventMonitor } = require('./lib/event-monitor');
+const { http2ResponseSkipHeaders, isHttp2Request, getHttp1Headers, acceptH2c } = require('./lib/h2c');
+const { isTunnelAddress, parseTunnelAddress, createTunnel } = require('./lib/tunnels');
+const { UpstreamSelector } = require('./lib/upstream-selector');
+const { ApiVersions, compareVersions, getRequestedVersion, parseApiVersion } = require('./lib/api-version');
+const { ResponseCache } = require('./lib/response-cache');
+const { userRuntimeDir, UserSockets } = require('./lib/user-sockets');
+const {
+  compileDownstreamSockets,
+  applySocketPermissions,
+  parseListenAddress,
+  loadTlsOptions,
+  listenOnSocket,
+  listenOnTcp,
+} = require('./lib/downstream');
+const {
+  podmanSocketsDir,
+  defaultMachineName,
+  socketKinds,
+  isSocket,
+  getMachineSocketPath,
+  withSocketKind,
+  discoverUpstreamSockets,
+  getSiblingSocket,
+  getMachineName,
+} = require('./lib/discovery');
+const { defaultPodmanPath, MachineStarter } = require('./lib/machine');
+const { runChecks, checkWslMounted, diagnoseUpstreamSocket, getDoctorChecks } = require('./lib/doctor');
+const { runSelfTest } = require('./lib/selftest');
+const { socketActivationArgs, installUnits, uninstallUnits } = require('./lib/install');
+const { getBuildInfo, formatBuildInfo } = require('./lib/build-info');
+const {
+  defaultPidFilePath,
+  AlreadyRunningError,
+  getRunningPid,
+  acquirePidFile,
+  releasePidFile,
+} = require('./lib/pid-file');
+const {
+  defaultLogFilePath,
+  getExecutable,
+  isDetached,
+  detach,
+  isHandoff,
+  handOver,
+  receiveListeners,
+  notifyReady,
+} = require('./lib/daemon');
+const { getSocketUri, getClientExports, registerClients, unregisterClients } = require('./lib/client-registration');
+const { MockUpstream } = require('./lib/mock-upstream');
+const { defaultPipeBridgePath, getDefaultPipeName, PipeBridge } = require('./lib/pipe-bridge');
+const { distroSocketsDir, getDistroSocketPath, listDistros, bindDistroRoot, toDistroPath } = require('./lib/distros');
+const { getServiceArgs, installBootstrapExecutable, DistroSupervisor } = require('./lib/bootstrap');
+const { isConnectionAddress, resolveConnection } = require('./lib/connections');
+const { ConnectionStats } = require('./lib/connection-stats');
+const {
+  faultKinds,
+  compileFaults,
+  pickFault,
+  pickErrorStatusCode,
+  resetResponse,
+  resetAfterFirstChunk,
+} = require('./lib/fault-injection');
+const { completionShells, generateCompletion } = require('./lib/completion');
 
-const defaultUpstreamSocketPath = '/mnt/wsl/podman-sockets/podman-machine-default/podman-root.sock';
+const defaultUpstreamSocketPath = getMachineSocketPath(defaultMachineName, 'root');
 const defaultDownstreamSocketPath = '/run/podman/podman.sock';
+const defaultSharedRootDir = '/mnt/wsl/distro-roots';
+const propagationModes = ['rslave', 'rshared', 'rprivate'];
+const virtualFilesystemDirectories = ['/dev', '/proc', '/run', '/sys'];
+
+function collect(value, previous) {
+  return previous.concat([value]);
+}
+
+let command = 'serve';
+const buildInfo = getBuildInfo();
+
+// Every option can be set in the environment as well, e.g. --log-level as PODMAN_WSL_SERVICE_LOG_LEVEL. The command
+// line takes precedence.
+const envPrefix = 'PODMAN_WSL_SERVICE_';
+program.createOption = (flags, description) => {
+  const option = new Option(flags, description);
+  if (option.long === '--version') {
+    return option;
+  }
+  return option.env(`${envPrefix}${option.long.slice(2).replace(/-/g, '_').toUpperCase()}`);
+};
 
 program
   .name('podman-wsl-service')
+  .version(formatBuildInfo(buildInfo), '-V, --version', 'Print the version and build information')
+  .option('-c, --config <path>', 'The path to the JSON config file', defaultConfigPath)
   .option('-l, --log-level <level>', 'Set the log level (debug, info, error)', 'info')
-  .option('-u, --upstream-socket <path>', 'The path to the upstream podman socket', defaultUpstreamSocketPath)
-  .option('-d, --downstream-socket <path>', 'The path to the downstream podman socket', defaultDownstreamSocketPath)
+  .option(
+    '-u, --upstream-socket <address>',
+    'The upstream socket path, tcp://, ssh:// or vsock:// URL or connection:<podman connection name>, repeatable ' +
+      `(default: "${defaultUpstreamSocketPath}")`,
+    collect,
+    []
+  )
+  .option('--mock-upstream', 'Forward to a fake podman API recording the requests instead of the upstream sockets')
+  .option('--ssh-identity <path>', 'The SSH identity file to use for ssh:// upstreams')
+  .option('--machine-name <name>', 'Use the socket exported by this podman machine instead of the default machine')
+  .option('--upstream-mode <mode>', 'Use the rootful (root) or rootless (user) socket of the machine (default: root)')
+  .option('-D, --discover-upstream', `Use the podman machine sockets found in ${podmanSocketsDir}`)
+  .option('--discovery-preference <kind>', 'Which discovered socket to prefer (root, user; default: root)')
+  .option('--route-by-uid', 'Route requests from non-root clients to the rootless socket of the upstream machine')
+  .option('--upstream-check-interval <seconds>', 'Interval between upstream health checks (0 to disable)', '5')
+  .option('--upstream-connect-timeout <seconds>', 'Fail connections to the upstream after this time', '5')
+  .option('--upstream-header-timeout <seconds>', 'Fail requests whose response has not started after this time', '0')
+  .option('--upstream-request-timeout <seconds>', 'Fail requests that have not finished after this time', '0')
+  .option('--cache-ttl <seconds>', 'Answer /_ping and /version from a cache for this long (0: never)', '2')
+  .option('--list-cache-ttl <seconds>', 'Answer container and image lists from a cache for this long (0: never)', '0')
+  .option('--auto-start-machine', 'Start the podman machine through WSL interop when the upstream is unavailable')
+  .option('--podman-path <path>', 'The podman executable used to start the machine', defaultPodmanPath)
+  .option('--wait-for-upstream', 'Wait for the upstream to answer before listening instead of failing requests')
+  .option('--wait-for-upstream-timeout <seconds>', 'Give up waiting for the upstream after this time (0: never)', '0')
+  .option(
+    '-d, --downstream-socket <path>',
+    `The path to the downstream podman socket, repeatable (default: "${defaultDownstreamSocketPath}")`,
+    collect,
+    []
+  )
+  .option('--socket-mode <mode>', 'The mode of the downstream sockets, e.g. 0660 (default: from the umask)')
+  .option('--socket-owner <user>', 'The user name or UID owning the downstream sockets')
+  .option('--socket-group <group>', 'The group name or GID of the downstream sockets, e.g. podman')
+  .option(
+    '--socket-acl <entry>',
+    'An ACL entry for the downstream sockets, e.g. user:vscode:rw (repeatable, needs setfacl)',
+    collect,
+    []
+  )
+  .option('--listen <address>', 'Additional address to listen on, e.g. tcp://127.0.0.1:2375 (repeatable)', collect, [])
+  .option('--tls-cert-dir <dir>', 'Directory with cert.pem, key.pem and ca.pem for the TCP listeners')
+  .option('--tls-cert <path>', 'TLS certificate for the TCP listeners')
+  .option('--tls-key <path>', 'TLS key for the TCP listeners')
+  .option('--tls-ca <path>', 'CA to verify client certificates on the TCP listeners against')
+  .option(
+    '-U, --per-user-sockets',
+    `Serve a socket in ${userRuntimeDir}/<uid>/podman/ for every logged in user instead of the downstream socket`
+  )
+  .option('--max-connections <count>', 'Reject requests beyond this many concurrent ones with 503 (0: no limit)', '0')
+  .option('--events-heartbeat <seconds>', 'Send a newline on idle event streams at this interval (0: never)', '0')
+  .option('--max-body-size <bytes>', 'Reject larger container create bodies with 413 (0: no limit)', '16777216')
+  .option('--min-api-version <version>', 'Reject requests for older Docker API versions with 400, e.g. 1.40')
+  .option('--stream-buffer-size <bytes>', 'Buffer size of the attach, exec and WebSocket streams', '65536')
+  .option('--fault-rate <percent>', 'Inject faults into this percentage of requests, to test clients (0: never)', '0')
+  .option('--fault-kinds <kinds>', `The faults to inject (${faultKinds.join(', ')})`, faultKinds.join(','))
+  .option('--fault-latency <ms>', 'The delay of the injected latency faults in milliseconds', '1000')
+  .option('--stream-idle-timeout <minutes>', 'Close streams without traffic in either direction (0: never)', '0')
+  .option('--no-h2c', 'Do not accept cleartext HTTP/2 connections on the downstream sockets')
+  .option('--named-pipe [name]', 'Also expose the API to Windows as \\\\.\\pipe\\<name> (default: podman-wsl-<distro>)')
+  .option('--pipe-bridge <path>', 'The Windows executable listening on the named pipe', defaultPipeBridgePath)
+  .option(
+    '--serve-distro <name>',
+    `Also serve another distro, with its socket in ${distroSocketsDir}/<name>/ ("all": every distro, repeatable)`,
+    collect,
+    []
+  )
   .option('-n, --wsl-distro-name <name>', 'The name of the WSL distro (default: autodetect)', '')
   .option('-M, --no-mount-distro-root', 'Do not mount the distro root')
+  .option(
+    '--rootless',
+    'Run without root: use the mounted distro root, a socket in $XDG_RUNTIME_DIR and the rootless machine socket'
+  )
+  .option('--share-dir <dir>', 'Only share this directory of the distro root (repeatable)', collect, [])
+  .option('--mask-virtual-filesystems', 'Hide /dev, /proc, /run and /sys of the distro from the machine')
+  .option(
+    '--shared-root-propagation <mode>',
+    `Mount propagation of the shared root (${propagationModes.join(', ')})`,
+    'rslave'
+  )
+  .option('--no-make-root-shared', 'Do not make the distro root a shared mount before binding it')
+  .option('--shared-root-ro', 'Share the distro root read-only and make the translated bind mounts read-only')
+  .option('--mount-check-interval <seconds>', 'Interval between checks of the shared root (0 to disable)', '30')
+  .option(
+    '--translation-summary-interval <seconds>',
+    'Interval between summaries of the bind source translations in the log (0 to disable)',
+    '3600'
+  )
+  .option('--status-interval <seconds>', 'Interval between status lines in the log (0 to disable)', '3600')
+  .option('--shared-root-dir <dir>', `The directory to share distro roots in (default: "${defaultSharedRootDir}")`)
+  .option(
+    '-f, --on-translation-failure <mode>',
+    `What to do with mounts whose path cannot be translated (${translationFailureModes.join(', ')})`,
+    'strict'
+  )
+  .option('--dry-run', 'Only log how bind mounts would be translated and forward create requests unchanged')
+  .option('-w, --api-warnings', 'Add a warning to container create responses for every rewritten bind mount')
+  .option('--map-drives', 'Translate Windows drive paths to the mount points of the drives in the machine')
+  .option('--path-cache-ttl <seconds>', 'Remember translated bind sources for this long (0: never)', '60')
+  .option('--validate-mounts', 'Reject container creation if a bind mount source does not exist')
+  .option(
+    '--create-hook <command>',
+    'Pass container create bodies through this executable before forwarding them (repeatable)',
+    collect,
+    []
+  )
+  .option(
+    '--webhook <url>',
+    'POST the container create, start and remove events seen by the proxy to this URL (repeatable)',
+    collect,
+    []
+  )
+  .option('-L, --no-label-containers', 'Do not label created containers with the client distro, user and program')
+  .option('--monitor-events', 'Log the lifecycle events of the containers created through the service')
+  .option('-H, --forward-client-headers', 'Forward the client identity to the upstream as X-WSL-* headers')
+  .option('--no-drive-warnings', 'Do not warn about bind sources on the Windows drives, which are slow to access')
+  .option('--no-client-lookup', 'Do not look up the client user and program of connections (no labels or headers)')
+  .option('-r, --read-only', 'Only forward read-only (GET/HEAD) requests and reject everything else')
+  .option('--allow-uid <user>', 'Only allow requests from the given user name or UID (repeatable)', collect, [])
+  .option(
+    '--allow-group <group>',
+    'Only allow requests from members of the given group name or GID (repeatable)',
+    collect,
+    []
+  )
+  .option('--user <user>', 'Switch to this user name or UID once the shared root and the sockets are set up')
+  .option('--group <group>', 'Switch to this group name or GID with --user (default: the primary group of the user)')
+  .option('--time <seconds>', 'Like podman system service --time: exit after this many idle seconds (0: never)')
   .option(
     '-t, --shutdown-timeout <timeout>',
     'Time in seconds after which the proxy will shut down if no connections are active (-1 to disable, default: disabled)',
     '-1'
   )
-  .parse(process.argv);
+  .option('--cleanup-on-exit', 'Unmount the shared root when the service stops')
+  .option(
+    '--pid-file <path>',
+    `Write the PID to this file and refuse to start while another instance runs (default: "${defaultPidFilePath}")`
+  )
+  .option('--register-clients', 'Point the docker and podman clients of all users to the service once it listens')
+  .option('--detach', 'Continue in the background once the service is listening')
+  .option('--log-file <path>', 'The file to write the logs to with --detach', defaultLogFilePath)
+  .option(
+    '--bootstrap-distro <name>',
+    'Run the service in this distro with wsl.exe and keep it running instead of here ("all": every distro, repeatable)',
+    collect,
+    []
+  )
+  .option('--bootstrap-executable <path>', 'The executable in the bootstrapped distros (default: a copy in /mnt/wsl)');
 
-const options = program.opts();
-const logLevel = options.logLevel;
-const upstreamSocketPath = options.upstreamSocket;
-const downstreamSocketPath = options.downstreamSocket;
-const wslDistroName = options.wslDistroName;
-const mountDistroRoot = options.mountDistroRoot;
-const shutdownTimeout = parseInt(options.shutdownTimeout);
+// The options apply to all commands, which only pick what to do with them
+const commandDescriptions = {
+  serve: 'Serve the API on the downstream sockets (default)',
+  check: 'Check wslpath, /mnt/wsl and the upstream sockets',
+  doctor: 'Diagnose the WSL setup and suggest fixes',
+  env: 'Print the DOCKER_HOST and CONTAINER_HOST exports for the service',
+  mount: 'Mount the shared root and exit',
+  umount: 'Unmount the shared root and exit',
+  cleanup: 'Unmount the shared root and remove the downstream sockets left behind by a stopped service',
+};
+for (const [name, description] of Object.entries(commandDescriptions)) {
+  program
+    .command(name, { isDefault: name === 'serve' })
+    .description(description)
+    .action(() => {
+      command = name;
+    });
+}
+
+let socketActivation = true;
+program
+  .command('install')
+  .description('Install and enable systemd units running the service with the given options')
+  .option('--no-socket', 'Run the service all the time instead of starting it on the first connection')
+  .action((installOptions) => {
+    command = 'install';
+    socketActivation = installOptions.socket;
+  });
+program
+  .command('uninstall')
+  .description('Disable and remove the systemd units')
+  .action(() => {
+    command = 'uninstall';
+  });
+
+let completionShell = null;
+program
+  .command('completion <shell>')
+  .description(`Print the completion script for the shell (${completionShells.join(', ')})`)
+  .action((shell) => {
+    command = 'completion';
+    completionShell = shell;
+  });
 
-const sharedRoot = getSharedMountpoint(wslDistroName || getWslDistroName());
+let translateArguments = [];
+program
+  .command('translate <paths...>')
+  .description('Print how the proxy would translate the given bind mount sources')
+  .action((paths) => {
+    command = 'translate';
+    translateArguments = paths;
+  });
 
-const systemdSocketFd = systemdSocket();
+let selfTestImage = null;
+program
+  .command('selftest')
+  .description('Check that a container writing to a bind mount through the downstream socket reaches the distro')
+  .option('--image <image>', 'The image to run, pulled if missing', 'docker.io/library/alpine:latest')
+  .action((selfTestOptions) => {
+    command = 'selftest';
+    selfTestImage = selfTestOptions.image;
+  });
+
+let filterRequest = null;
+program
+  .command('filter <method> <path>')
+  .description('Read a request body from stdin and write it to stdout as the proxy would forward it')
+  .action((method, apiPath) => {
+    command = 'filter';
+    filterRequest = { method: method.toUpperCase(), url: apiPath };
+  });
+
+program.parse(process.argv);
+
+if (command === 'completion') {
+  if (!completionShells.includes(completionShell)) {
+    console.error(`Invalid shell: ${completionShell}`);
+    process.exit(1);
+  }
+  process.stdout.write(generateCompletion(completionShell, program));
+  process.exit(0);
+}
+
+const options = program.opts();
+let logLevel = options.logLevel;
+const perUserSockets = !!options.perUserSockets;
+const h2c = options.h2c;
+const wslDistroName = options.wslDistroName;
+// Without root, the distro root is expected to be mounted already, e.g. by a oneshot unit running the mount command
+const rootless = !!options.rootless;
+const runtimeDir = process.env.XDG_RUNTIME_DIR || `/run/user/${process.getuid()}`;
+const mountDistroRoot = options.mountDistroRoot && !rootless;
+const maskVirtualFilesystems = !!options.maskVirtualFilesystems;
+const sharedRootReadOnly = !!options.sharedRootRo;
+const sharedRootPropagation = options.sharedRootPropagation;
+const makeRootShared = options.makeRootShared;
+const cleanupOnExit = !!options.cleanupOnExit;
+const pidFile = options.pidFile || (rootless ? path.join(runtimeDir, 'podman-wsl-service.pid') : defaultPidFilePath);
+// Rootless services use the rootless socket of the machine by default
+const upstreamMode = options.upstreamMode || (rootless ? 'user' : 'root');
+if (!socketKinds[upstreamMode]) {
+  console.error(`Invalid upstream mode: ${upstreamMode}, expected root or user`);
+  process.exit(1);
+}
+const upstreamSocketDefault = getMachineSocketPath(defaultMachineName, upstreamMode);
+const downstreamSocketDefault = rootless ? path.join(runtimeDir, 'podman', 'podman.sock') : defaultDownstreamSocketPath;
+const detachService = !!options.detach;
+const registerClientsOnStart = !!options.registerClients;
+const mountCheckInterval = parseFloat(options.mountCheckInterval);
+const translationSummaryInterval = parseFloat(options.translationSummaryInterval);
+const statusInterval = parseFloat(options.statusInterval);
+const apiWarnings = !!options.apiWarnings;
+const dryRun = !!options.dryRun;
+const validateMounts = !!options.validateMounts;
+const mapDrives = !!options.mapDrives;
+const labelContainers = options.labelContainers;
+const monitorEvents = !!options.monitorEvents;
+const driveWarnings = options.driveWarnings;
+const forwardClientHeaders = !!options.forwardClientHeaders;
+const clientLookup = options.clientLookup;
+const readOnly = !!options.readOnly;
+const routeByUid = !!options.routeByUid;
+const waitForUpstream = !!options.waitForUpstream;
+const waitForUpstreamTimeout = parseInt(options.waitForUpstreamTimeout);
+const upstreamTimeouts = {
+  connect: parseFloat(options.upstreamConnectTimeout),
+  header: parseFloat(options.upstreamHeaderTimeout),
+  request: parseFloat(options.upstreamRequestTimeout),
+};
+const maxConnections = parseInt(options.maxConnections);
+const eventsHeartbeat = parseFloat(options.eventsHeartbeat);
+const streamBufferSize = parseInt(options.streamBufferSize);
+const maxBodySize = parseInt(options.maxBodySize);
+const minApiVersion = options.minApiVersion || null;
+const streamIdleTimeout = parseFloat(options.streamIdleTimeout);
+const shutdownTimeout = parseInt(options.time !== undefined ? options.time : options.shutdownTimeout);
 
 const logLevels = ['debug', 'info', 'error'];
 if (!logLevels.includes(logLevel)) {
@@ -43,24 +440,480 @@ if (!logLevels.includes(logLevel)) {
 }
 console.log = (msg) => (logLevel === 'info' || logLevel === 'debug' ? console.info(msg) : () => {});
 console.debug = (msg) => (logLevel === 'debug' ? console.info(msg) : () => {});
+// The filter command writes the body to stdout
+if (command === 'filter') {
+  console.info = console.error;
+}
+
+// The log level can be changed while running, e.g. to enable debug logging for a reproduction without restarting the
+// service and ending the attach sessions
+function setLogLevel(level) {
+  if (level !== logLevel) {
+    console.info(`Log level changed from ${logLevel} to ${level}`);
+    logLevel = level;
+  }
+}
+
+// SIGUSR1 makes the logging more verbose and SIGUSR2 less
+process.on('SIGUSR1', () => setLogLevel(logLevels[Math.max(logLevels.indexOf(logLevel) - 1, 0)]));
+process.on('SIGUSR2', () => setLogLevel(logLevels[Math.min(logLevels.indexOf(logLevel) + 1, logLevels.length - 1)]));
+
+const mockUpstream = options.mockUpstream ? new MockUpstream() : null;
+
+const distroName = wslDistroName || getWslDistroName();
+
+// Socket paths may refer to the user running the service and the distro, e.g. /run/%d/podman-%u.sock
+function expandSocketPath(socketPath) {
+  const uid = process.getuid();
+  return expandPlaceholders(socketPath, { u: getUserName(uid), U: String(uid), d: distroName });
+}
+
+// The SSH identities of the podman connections, by URI
+const connectionIdentities = new Map();
+
+let config,
+  sharedRootDir,
+  sharedDirectories,
+  pathRules,
+  driveMappings,
+  shareMappings,
+  mountPolicy,
+  apiPolicy,
+  createHooks,
+  webhooks,
+  failureModes,
+  upstreamSocketPaths,
+  downstreamSockets;
+const tcpListeners = [];
+let tlsOptions = null;
+try {
+  config = loadConfig(options.config, program.getOptionValueSource('config') !== 'default');
+  const explicitSockets = options.downstreamSocket.length ? options.downstreamSocket : config.downstreamSockets;
+  downstreamSockets = explicitSockets ? compileDownstreamSockets(explicitSockets) : [];
+  const listenAddresses = options.listen.length ? options.listen : config.listen || [];
+  if (!Array.isArray(listenAddresses)) {
+    // noinspection ExceptionCaughtLocallyJS
+    throw new Error('"listen" must be an array');
+  }
+  for (const spec of listenAddresses.map(parseListenAddress)) {
+    (spec.tcp ? tcpListeners : downstreamSockets).push(spec);
+  }
+  downstreamSockets.forEach((spec) => (spec.path = expandSocketPath(spec.path)));
+  tlsOptions = loadTlsOptions({
+    certDir: options.tlsCertDir,
+    cert: options.tlsCert,
+    key: options.tlsKey,
+    ca: options.tlsCa,
+  });
+  upstreamSocketPaths = options.upstreamSocket.length ? options.upstreamSocket : config.upstreamSockets;
+  if (options.machineName) {
+    if (options.upstreamSocket.length || options.discoverUpstream) {
+      // noinspection ExceptionCaughtLocallyJS
+      throw new Error('--machine-name cannot be combined with --upstream-socket or --discover-upstream');
+    }
+    upstreamSocketPaths = [getMachineSocketPath(options.machineName, upstreamMode)];
+  }
+  if (mockUpstream) {
+    upstreamSocketPaths = [mockUpstream.socketPath];
+  } else if (options.discoverUpstream) {
+    upstreamSocketPaths = discoverUpstreams(options.discoveryPreference || upstreamMode);
+  } else if (upstreamSocketPaths === undefined) {
+    upstreamSocketPaths = [upstreamSocketDefault];
+  } else if (!Array.isArray(upstreamSocketPaths) || !upstreamSocketPaths.length) {
+    // noinspection ExceptionCaughtLocallyJS
+    throw new Error('"upstreamSockets" must be a non-empty array');
+  } else {
+    upstreamSocketPaths = upstreamSocketPaths.map(expandSocketPath);
+    // The mode picks the socket of the same machine for the machine sockets given by path
+    if (options.upstreamMode) {
+      upstreamSocketPaths = upstreamSocketPaths.map((address) => withSocketKind(address, upstreamMode));
+    }
+  }
+  // Connections defined for podman-remote are used by name
+  upstreamSocketPaths = upstreamSocketPaths.map((address) => {
+    if (!isConnectionAddress(address)) {
+      return address;
+    }
+    const { uri, identity } = resolveConnection(address);
+    console.debug(`Podman ${address} is ${uri}`);
+    if (identity) {
+      connectionIdentities.set(uri, identity);
+    }
+    return uri;
+  });
+  for (const [name, timeout] of Object.entries(upstreamTimeouts)) {
+    if (!(timeout >= 0)) {
+      // noinspection ExceptionCaughtLocallyJS
+      throw new Error(`invalid upstream ${name} timeout: ${timeout}`);
+    }
+  }
+  if (!(maxConnections >= 0)) {
+    // noinspection ExceptionCaughtLocallyJS
+    throw new Error(`invalid connection limit: ${options.maxConnections}`);
+  }
+  if (!(eventsHeartbeat >= 0)) {
+    // noinspection ExceptionCaughtLocallyJS
+    throw new Error(`invalid events heartbeat interval: ${options.eventsHeartbeat}`);
+  }
+  if (!(maxBodySize >= 0)) {
+    // noinspection ExceptionCaughtLocallyJS
+    throw new Error(`invalid maximum body size: ${options.maxBodySize}`);
+  }
+  if (minApiVersion) {
+    parseApiVersion(minApiVersion);
+  }
+  if (!(streamBufferSize > 0)) {
+    // noinspection ExceptionCaughtLocallyJS
+    throw new Error(`invalid stream buffer size: ${options.streamBufferSize}`);
+  }
+  if (!(streamIdleTimeout >= 0)) {
+    // noinspection ExceptionCaughtLocallyJS
+    throw new Error(`invalid stream idle timeout: ${options.streamIdleTimeout}`);
+  }
+  upstreamSocketPaths.forEach((address) =>
+    isTunnelAddress(address) ? parseTunnelAddress(address) : parseUpstreamAddress(address)
+  );
+  if (!propagationModes.includes(sharedRootPropagation)) {
+    // noinspection ExceptionCaughtLocallyJS
+    throw new Error(`invalid shared root propagation: ${sharedRootPropagation}`);
+  }
+  sharedRootDir = normalizePath(options.sharedRootDir || config.sharedRootDir || defaultSharedRootDir);
+  if (!sharedRootDir.startsWith('/mnt/wsl/')) {
+    // noinspection ExceptionCaughtLocallyJS
+    throw new Error(`the shared root directory must be below /mnt/wsl to be visible to the machine: ${sharedRootDir}`);
+  }
+  sharedDirectories = options.shareDir.length ? options.shareDir : config.sharedDirectories || [];
+  if (!Array.isArray(sharedDirectories) || sharedDirectories.some((dir) => !path.posix.isAbsolute(dir))) {
+    // noinspection ExceptionCaughtLocallyJS
+    throw new Error('"sharedDirectories" must be an array of absolute paths');
+  }
+  sharedDirectories = sharedDirectories.map(normalizePath);
+  pathRules = compilePathRules(config.pathRules);
+  driveMappings = compileDriveMappings(config.driveMappings);
+  shareMappings = compileShareMappings(config.shareMappings);
+  mountPolicy = compileMountPolicy(config.mountPolicy);
+  createHooks = compileCreateHooks(options.createHook.length ? options.createHook : config.createHooks || []);
+  webhooks = compileWebhooks(options.webhook.length ? options.webhook : config.webhooks || []);
+  apiPolicy = compileApiPolicy(config.apiPolicy);
+  failureModes = compileTranslationFailureModes(options.onTranslationFailure, config.translationFailureModes);
+} catch (err) {
+  console.error(`Invalid configuration: ${err.message}`);
+  process.exit(1);
+}
+
+let faults;
+try {
+  faults = compileFaults({ rate: options.faultRate, kinds: options.faultKinds, latency: options.faultLatency });
+} catch (err) {
+  console.error(`Invalid fault injection: ${err.message}`);
+  process.exit(1);
+}
+
+let allowedUids, allowedGids;
+try {
+  allowedUids = options.allowUid.map(resolveUid);
+  allowedGids = options.allowGroup.map(resolveGid);
+} catch (err) {
+  console.error(`Unable to resolve the allowed users and groups: ${err.message}`);
+  process.exit(1);
+}
+if (!clientLookup && (allowedUids.length || allowedGids.length)) {
+  console.error('--allow-uid and --allow-group need the client lookup, which --no-client-lookup turns off');
+  process.exit(1);
+}
+
+// The user and group the service switches to once it is set up, so requests are not parsed as root
+let dropUid = null,
+  dropGid = null;
+try {
+  if (options.user) {
+    dropUid = resolveUid(options.user);
+    dropGid = options.group ? resolveGid(options.group) : getUserGid(dropUid);
+  } else if (options.group) {
+    throw new Error('--group needs --user');
+  }
+} catch (err) {
+  console.error(`Unable to resolve the user to switch to: ${err.message}`);
+  process.exit(1);
+}
+// Looking up the clients of other users, creating per-user sockets and unmounting take root
+const rootOnlyOptions = [
+  [allowedUids.length || allowedGids.length, '--allow-uid and --allow-group'],
+  [perUserSockets, '--per-user-sockets'],
+  [cleanupOnExit, '--cleanup-on-exit'],
+];
+for (const [enabled, name] of rootOnlyOptions) {
+  if (dropUid !== null && enabled) {
+    console.error(`${name} cannot be used with --user, they need to run as root`);
+    process.exit(1);
+  }
+}
+
+// A machine exporting only the socket of the other mode runs in the other mode, which waiting would not change. A
+// machine exporting neither is not running, which is left to the health checks.
+if (command === 'serve' && (options.upstreamMode || options.machineName)) {
+  for (const address of upstreamSocketPaths) {
+    const otherMode = upstreamMode === 'root' ? 'user' : 'root';
+    if (getMachineName(address) && !isSocket(address) && getSiblingSocket(address, otherMode)) {
+      const diagnosis = diagnoseUpstreamSocket(address);
+      console.error(`Upstream socket ${address} does not exist: ${diagnosis.cause}. Fix: ${diagnosis.fix}`);
+      process.exit(1);
+    }
+  }
+}
+
+// SSH and vsock upstreams are reached through a local socket forwarded by ssh or socat
+const tunnels = [];
+const upstreamAddresses = upstreamSocketPaths.map((address) => {
+  if (!isTunnelAddress(address)) {
+    return address;
+  }
+  const tunnel = createTunnel(address, { sshIdentity: connectionIdentities.get(address) || options.sshIdentity });
+  tunnels.push(tunnel);
+  return tunnel.socketPath;
+});
+const upstreams = new UpstreamSelector(upstreamAddresses, parseInt(options.upstreamCheckInterval));
+const apiVersions = new ApiVersions();
+const responseCache = new ResponseCache(parseFloat(options.cacheTtl), parseFloat(options.listCacheTtl));
+upstreams.on('change', () => {
+  apiVersions.clear();
+  responseCache.clear();
+  if (eventMonitor) {
+    eventMonitor.restart();
+  }
+  const diagnosis = upstreams.available ? null : diagnoseUpstream();
+  if (diagnosis) {
+    console.error(`Upstream socket ${upstreams.active} is missing: ${diagnosis.cause}. Fix: ${diagnosis.fix}`);
+  }
+});
+
+// Why the upstream socket is missing, if it is one the machine exports
+function diagnoseUpstream(address = upstreams.active) {
+  const { socketPath } = parseUpstreamAddress(address);
+  if (!socketPath || mockUpstream || tunnels.some((tunnel) => tunnel.socketPath === socketPath)) {
+    return null;
+  }
+  return diagnoseUpstreamSocket(socketPath);
+}
+
+// The cause of the 503 errors, with the fix if the socket is missing
+function getUnavailableError(err, address = upstreams.active) {
+  const diagnosis = diagnoseUpstream(address);
+  return diagnosis ? new Error(`${diagnosis.cause}; to fix it, ${diagnosis.fix}`) : err;
+}
+const machineStarter = options.autoStartMachine
+  ? new MachineStarter(options.podmanPath, getMachineName(upstreamAddresses[0]) || defaultMachineName, (timeout) =>
+      upstreams.waitForLive(timeout)
+    )
+  : null;
+const sharedRoot = getSharedMountpoint(distroName);
+
+const systemdSocketFd = systemdSocket();
+
+// The default downstream socket is replaced by the systemd socket or the per-user sockets
+if (!downstreamSockets.length && !systemdSocketFd && !perUserSockets) {
+  downstreamSockets = compileDownstreamSockets([downstreamSocketDefault]);
+}
+
+// Other distros can be served by this one: their roots are bound through wsl.exe, and their sockets are on /mnt/wsl
+let servedDistros = options.serveDistro.length ? options.serveDistro : config.serveDistros || [];
+try {
+  if (!Array.isArray(servedDistros) || servedDistros.some((name) => typeof name !== 'string')) {
+    // noinspection ExceptionCaughtLocallyJS
+    throw new Error('"serveDistros" must be an array of distro names');
+  }
+  if (servedDistros.includes('all')) {
+    servedDistros = listDistros();
+  }
+  const invalid = servedDistros.find((name) => !/^[\w.-]+$/.test(name));
+  if (invalid) {
+    // noinspection ExceptionCaughtLocallyJS
+    throw new Error(`invalid distro name: ${invalid}`);
+  }
+} catch (err) {
+  console.error(`Unable to serve other distros: ${err.message}`);
+  process.exit(1);
+}
+servedDistros = [...new Set(servedDistros)].filter((name) => name.toLowerCase() !== distroName.toLowerCase());
+for (const name of servedDistros) {
+  downstreamSockets.push({ ...compileDownstreamSockets([getDistroSocketPath(name)])[0], distro: name });
+}
+const socketPermissions = {
+  mode: options.socketMode,
+  owner: options.socketOwner,
+  group: options.socketGroup,
+  acl: options.socketAcl,
+};
+try {
+  applySocketPermissions(downstreamSockets, socketPermissions);
+} catch (err) {
+  console.error(`Invalid socket permissions: ${err.message}`);
+  process.exit(1);
+}
 
 console.debug('Options:');
 console.debug(`- Log level: ${logLevel}`);
-console.debug(`- Upstream socket: ${upstreamSocketPath}`);
-console.debug(`- Downstream socket: ${systemdSocketFd && systemdSocketFd.fd ? 'systemd' : downstreamSocketPath}`);
+console.debug(`- Config file: ${options.config}`);
+console.debug(`- Path rules: ${pathRules.length}`);
+console.debug(`- Map drives: ${mapDrives ? `yes (${Object.keys(driveMappings).length} custom mappings)` : 'no'}`);
+console.debug(`- Mount policy: ${mountPolicy ? `${mountPolicy.entries.length} entries` : 'none'}`);
+console.debug(`- Create hooks: ${createHooks.length ? createHooks.map((hook) => hook.name).join(', ') : 'none'}`);
+console.debug(`- Webhooks: ${webhooks.length ? webhooks.map((url) => url.origin).join(', ') : 'none'}`);
+console.debug(
+  `- API policy: ${apiPolicy ? `${apiPolicy.allow.length} allowed, ${apiPolicy.deny.length} denied` : 'none'}`
+);
+console.debug(`- Upstream sockets: ${upstreamSocketPaths.join(', ')}`);
+console.debug(`- Route by UID: ${routeByUid}`);
+const describeTimeout = (timeout) => (timeout > 0 ? `${timeout}s` : 'none');
+console.debug(
+  `- Upstream timeouts: connect ${describeTimeout(upstreamTimeouts.connect)}, ` +
+    `header ${describeTimeout(upstreamTimeouts.header)}, request ${describeTimeout(upstreamTimeouts.request)}`
+);
+console.debug(`- Cache TTL: ${responseCache.ttl > 0 ? `${responseCache.ttl} seconds` : 'disabled'}`);
+console.debug(`- List cache TTL: ${responseCache.listTtl > 0 ? `${responseCache.listTtl} seconds` : 'disabled'}`);
+const waitDescription = waitForUpstreamTimeout > 0 ? `up to ${waitForUpstreamTimeout}s` : 'forever';
+console.debug(`- Auto-start machine: ${machineStarter ? machineStarter.machineName : 'no'}`);
+console.debug(`- Wait for upstream: ${waitForUpstream ? waitDescription : 'no'}`);
+const downstreamSocketNames = [...(systemdSocketFd ? ['systemd'] : []), ...downstreamSockets.map((s) => s.path)];
+console.debug(`- Downstream sockets: ${downstreamSocketNames.join(', ')}`);
+console.debug(
+  `- Socket permissions: mode ${socketPermissions.mode || 'default'}, ` +
+    `owner ${socketPermissions.owner || 'default'}, group ${socketPermissions.group || 'default'}, ` +
+    `ACL ${socketPermissions.acl.length ? socketPermissions.acl.join(',') : 'none'}`
+);
+console.debug(`- Served distros: ${servedDistros.length ? servedDistros.join(', ') : 'none'}`);
+console.debug(
+  `- Fault injection: ${faults ? `${options.faultRate}% of the requests (${faults.kinds.join(', ')})` : 'disabled'}`
+);
+console.debug(`- TCP listeners: ${tcpListeners.length ? tcpListeners.map((l) => l.address).join(', ') : 'none'}`);
+console.debug(`- TLS: ${tlsOptions ? (tlsOptions.requestCert ? 'mutual' : 'server only') : 'disabled'}`);
+console.debug(`- Per-user sockets: ${perUserSockets}`);
+console.debug(`- HTTP/2 (h2c): ${h2c}`);
+console.debug(`- Max connections: ${maxConnections || 'unlimited'}`);
+console.debug(`- Switch to user: ${dropUid !== null ? `${dropUid}, group ${dropGid}` : 'no'}`);
+console.debug(`- Events heartbeat: ${eventsHeartbeat > 0 ? `${eventsHeartbeat} seconds` : 'disabled'}`);
+console.debug(`- Stream buffer size: ${streamBufferSize} bytes`);
+console.debug(`- Max body size: ${maxBodySize > 0 ? `${maxBodySize} bytes` : 'no limit'}`);
+console.debug(`- Min API version: ${minApiVersion || 'none'}`);
+console.debug(`- Stream idle timeout: ${streamIdleTimeout > 0 ? `${streamIdleTimeout} minutes` : 'disabled'}`);
 console.debug(`- WSL distro name: ${wslDistroName || 'autodetect'}`);
 console.debug(`- Mount distro root: ${!mountDistroRoot}`);
+console.debug(`- Rootless: ${rootless}`);
+console.debug(`- On translation failure: ${failureModes.defaultMode} (${failureModes.prefixes.length} overrides)`);
+console.debug(`- API warnings: ${apiWarnings}`);
+console.debug(`- Dry run: ${dryRun}`);
+console.debug(`- Path cache TTL: ${options.pathCacheTtl} seconds`);
+console.debug(`- Validate mounts: ${validateMounts}`);
+console.debug(`- Label containers: ${labelContainers}`);
+console.debug(`- Monitor events: ${monitorEvents}`);
+console.debug(`- Forward client headers: ${forwardClientHeaders}`);
+console.debug(`- Client lookup: ${clientLookup}`);
+console.debug(`- Read-only: ${readOnly}`);
+console.debug(`- Allowed UIDs: ${allowedUids.length ? allowedUids.join(', ') : 'any'}`);
+console.debug(`- Allowed GIDs: ${allowedGids.length ? allowedGids.join(', ') : 'any'}`);
 console.debug(`- Shutdown timeout: ${shutdownTimeout < 0 ? 'disabled' : `${shutdownTimeout} seconds`}`);
 console.debug(`- Shared root: ${sharedRoot}`);
+console.debug(`- Mask virtual filesystems: ${maskVirtualFilesystems}`);
+console.debug(`- Shared root read-only: ${sharedRootReadOnly}`);
+console.debug(`- Shared root propagation: ${sharedRootPropagation}${makeRootShared ? ', root made shared' : ''}`);
+console.debug(`- Mount check interval: ${mountCheckInterval > 0 ? `${mountCheckInterval} seconds` : 'disabled'}`);
+const translationSummary = translationSummaryInterval > 0 ? `${translationSummaryInterval} seconds` : 'disabled';
+console.debug(`- Translation summary interval: ${translationSummary}`);
+console.debug(`- Status interval: ${statusInterval > 0 ? `${statusInterval} seconds` : 'disabled'}`);
+console.debug(`- Shared directories: ${sharedDirectories.length ? sharedDirectories.join(', ') : 'all'}`);
+console.debug(`- Automount root: ${automountRoot}`);
+console.debug(`- Cleanup on exit: ${cleanupOnExit}`);
+console.debug(`- PID file: ${pidFile}`);
+console.debug(`- Register clients: ${registerClientsOnStart}`);
+console.debug(`- Detach: ${detachService ? `yes, logging to ${options.logFile}` : 'no'}`);
+
+// Clients use the first downstream socket, which is also where the systemd socket unit listens by default
+const clientSocketPath = downstreamSockets.length ? downstreamSockets[0].path : downstreamSocketDefault;
+const clientSocketUri = getSocketUri(clientSocketPath, perUserSockets);
+
+let pipeBridge = null;
+if (options.namedPipe) {
+  const pipeName = options.namedPipe === true ? getDefaultPipeName(distroName) : options.namedPipe;
+  if (!/^[\w.-]+$/.test(pipeName)) {
+    console.error(`Invalid named pipe name: ${pipeName}`);
+    process.exit(1);
+  }
+  if (perUserSockets && !downstreamSockets.length) {
+    console.error('--named-pipe needs a downstream socket, which --per-user-sockets replaces');
+    process.exit(1);
+  }
+  const userName = getUserName(process.getuid());
+  pipeBridge = new PipeBridge(options.pipeBridge, pipeName, distroName, userName, clientSocketPath);
+}
+console.debug(`- Named pipe: ${pipeBridge ? `\\\\.\\pipe\\${pipeBridge.pipeName}` : 'none'}`);
+
+if (command === 'env') {
+  process.stdout.write(getClientExports(clientSocketUri));
+  process.exit(0);
+}
+
+if (command === 'install' || command === 'uninstall') {
+  if (process.getuid() !== 0) {
+    console.error('Please run as root');
+    process.exit(1);
+  }
+  try {
+    if (command === 'install') {
+      // systemd passes a single socket to the service, the ones given with --listen are still created by it
+      const socketCount = options.downstreamSocket.length || (config.downstreamSockets ? Infinity : 1);
+      if (socketActivation && socketCount > 1) {
+        // noinspection ExceptionCaughtLocallyJS
+        throw new Error('socket activation needs a single --downstream-socket on the command line, or use --no-socket');
+      }
+      const socketPath = options.downstreamSocket.length ? downstreamSockets[0].path : downstreamSocketDefault;
+      installUnits(getServiceCommandLine(), { socketActivation, socketPath, socketPermissions });
+    } else {
+      uninstallUnits();
+      unregisterClients();
+    }
+  } catch (err) {
+    console.error(`Unable to ${command} the systemd units: ${err.message}`);
+    process.exit(1);
+  }
+  process.exit(0);
+}
+
+if (command === 'cleanup' && getRunningPid(pidFile)) {
+  console.error(`The service is still running with PID ${getRunningPid(pidFile)}, stop it before cleaning up`);
+  process.exit(1);
+}
 
-if (mountDistroRoot) {
-  console.log(`Mounting shared mountpoint: ${sharedRoot}`);
-  mountSharedMountpoint(sharedRoot);
+if (command === 'mount' || command === 'umount' || command === 'cleanup') {
+  try {
+    if (command === 'mount') {
+      console.log(`Mounting shared mountpoint: ${sharedRoot}`);
+      mountSharedMountpoint(sharedRoot);
+    } else {
+      unmountSharedMountpoint(sharedRoot);
+    }
+  } catch (err) {
+    console.error(`Unable to ${command === 'mount' ? 'mount' : 'unmount'} the shared mountpoint: ${err.message}`);
+    process.exit(1);
+  }
+  if (command === 'cleanup') {
+    removeDownstreamSockets();
+  }
+  process.exit(0);
 }
 
 let activeConnections = 0;
+const connectionStats = new ConnectionStats(getClientCredentials);
+// SIGUSR2 lowers the log level, so the connections are dumped on SIGQUIT, like the thread dumps of the JVM
+process.on('SIGQUIT', () => connectionStats.log());
 let shutdownTimer = null;
 
+const connectionLimitMessage = 'Too many concurrent requests';
+
+// Called after counting the new connection
+function isOverConnectionLimit() {
+  return maxConnections > 0 && activeConnections > maxConnections;
+}
+
 function resetShutdownTimer() {
   if (shutdownTimer) {
     clearTimeout(shutdownTimer);
@@ -74,6 +927,39 @@ function resetShutdownTimer() {
   }
 }
 
+function discoverUpstreams(preference) {
+  if (!socketKinds[preference]) {
+    console.error(`Invalid discovery preference: ${preference}`);
+    process.exit(1);
+  }
+  const sockets = discoverUpstreamSockets(preference);
+  if (!sockets.length) {
+    console.error(`No podman machine sockets found in ${podmanSocketsDir}, using ${upstreamSocketDefault}`);
+    return [upstreamSocketDefault];
+  }
+  for (const socket of sockets) {
+    console.log(`Discovered ${socket.kind} socket of machine ${socket.machine}: ${socket.path}`);
+  }
+  return sockets.map((socket) => socket.path);
+}
+
+// The command line of the installed service: this executable with the options given to the install command
+// With socket activation, the downstream socket is the one systemd listens on, so it is left out of the command line
+function getServiceCommandLine() {
+  const args = process.argv.slice(2).filter((arg) => arg !== 'install' && arg !== '--no-socket');
+  if (socketActivation) {
+    for (let i = 0; i < args.length; i++) {
+      if (args[i] === '-d' || args[i] === '--downstream-socket') {
+        args.splice(i--, 2);
+      } else if (args[i].startsWith('--downstream-socket=') || /^-d./.test(args[i])) {
+        args.splice(i--, 1);
+      }
+    }
+  }
+  const idleTimeSet = ['time', 'shutdownTimeout'].some((name) => program.getOptionValueSource(name) === 'cli');
+  return getExecutable().concat(args, socketActivation && !idleTimeSet ? socketActivationArgs : []);
+}
+
 function getWslDistroName() {
   const distroName = process.env.WSL_DISTRO_NAME;
   if (distroName) {
@@ -94,150 +980,1194 @@ function getWslDistroName() {
 }
 
 function getSharedMountpoint(distroName) {
-  return `/mnt/wsl/distro-roots/${distroName}`;
+  return path.posix.join(sharedRootDir, distroName);
 }
 
+// Shares the whole distro root, or only the configured directories at their place below the mount point
 function mountSharedMountpoint(mountPoint) {
-  if (!fs.existsSync(mountPoint)) {
-    fs.mkdirSync(mountPoint, { recursive: true });
+  // Slave and shared propagation need a shared source to receive mounts made in the distro later on
+  if (makeRootShared) {
+    execFileSync('mount', ['--make-shared', '/']);
   }
-  try {
-    // Check if the mount point is already mounted
-    let isMounted;
+  if (!sharedDirectories.length) {
+    bindMount('/', mountPoint);
+  }
+  for (const dir of sharedDirectories) {
+    bindMount(dir, path.join(mountPoint, dir));
+  }
+  if (maskVirtualFilesystems) {
+    unmountVirtualFilesystems(mountPoint);
+  }
+  if (sharedRootReadOnly) {
+    remountReadOnly(mountPoint);
+  }
+}
+
+// The roots of the served distros are bound when they are not mounted yet, at startup and when WSL reset /mnt/wsl
+function checkServedDistroRoots() {
+  if (!servedDistros.length) {
+    return;
+  }
+  const mountPoints = new Set(readMountInfo().map((mount) => mount.mountPoint));
+  for (const name of servedDistros.filter((name) => !mountPoints.has(getSharedMountpoint(name)))) {
     try {
-      execFileSync('mountpoint', ['-q', mountPoint]);
-      isMounted = true;
+      bindDistroRoot(name, getSharedMountpoint(name), sharedRootPropagation);
+      console.log(`Mounted the root of distro ${name} on ${getSharedMountpoint(name)}`);
     } catch (err) {
-      isMounted = false;
+      console.error(`Unable to mount the root of distro ${name}: ${(err.stderr || err.message).toString().trim()}`);
     }
+  }
+}
+
+// The sources of the shared root and where they are bound
+function getSharedBinds() {
+  return sharedDirectories.length
+    ? sharedDirectories.map((dir) => [dir, path.join(sharedRoot, dir)])
+    : [['/', sharedRoot]];
+}
+
+function isSharedMountpointMounted(mounts = readMountInfo()) {
+  return getSharedBinds().every(([source, target]) => isBindOf(source, target, mounts));
+}
 
-    let options = 'rbind,rslave';
-    if (isMounted) {
-      options += ',remount';
+// The tmpfs on /mnt/wsl is shared by all distros and starts over when WSL resets it, e.g. when another distro is shut
+// down, taking the shared root with it. The binds are set up again when they are gone.
+function checkSharedMountpoint() {
+  const mounts = readMountInfo();
+  try {
+    if (isSharedMountpointMounted(mounts)) {
+      shareLateMounts(getSharedBinds().map(([source]) => source), mounts);
+      return;
     }
-    execFileSync('mount', ['--make-shared', '/']);
-    execFileSync('mount', ['/', mountPoint, '-o', options]);
+    console.error(`The shared mountpoint ${sharedRoot} is gone, mounting it again`);
+    mountSharedMountpoint(sharedRoot);
   } catch (err) {
     console.error(`Unable to mount the shared mountpoint: ${err.message}`);
-    process.exit(1);
   }
 }
 
-function writeError(res, statusCode, message, err) {
-  res.writeHead(statusCode, { 'Content-Type': 'application/json' });
-  res.end(
-    JSON.stringify({
-      response: statusCode,
-      message: `podman-wsl-service: ${message}: ${err.message}`,
-      cause: err.message,
-    })
-  );
+// Mounts made in the distro after the shared root was bound, e.g. USB drives or sshfs, only propagate to it with
+// rslave or rshared propagation of a shared distro root. Missing ones are bound to the shared root one by one.
+// Mounts under /mnt/wsl are left out, their paths are passed through untranslated.
+function shareLateMounts(sources, mounts) {
+  const mountPoints = new Set(mounts.map((mount) => mount.mountPoint));
+  const shared = [];
+  for (const mountPoint of [...mountPoints].sort()) {
+    const isMissing =
+      sources.some((source) => mountPoint !== source && isSubpath(mountPoint, source)) &&
+      !isSubpath(mountPoint, '/mnt/wsl') &&
+      !isSubpath(mountPoint, sharedRootDir) &&
+      !(maskVirtualFilesystems && virtualFilesystemDirectories.some((dir) => isSubpath(mountPoint, dir))) &&
+      !shared.some((dir) => isSubpath(mountPoint, dir)) &&
+      !mountPoints.has(path.posix.join(sharedRoot, mountPoint));
+    if (!isMissing) {
+      continue;
+    }
+    const target = path.posix.join(sharedRoot, mountPoint);
+    console.log(`Sharing ${mountPoint}, which was mounted after the shared root`);
+    bindMount(mountPoint, target);
+    if (sharedRootReadOnly) {
+      remountReadOnly(target);
+    }
+    shared.push(mountPoint);
+  }
 }
 
-function wslPathToWindowsPath(wslPath) {
-  return execFileSync('wslpath', ['-aw', wslPath]).toString().trim();
+// A bind is live if its mount point shows the same filesystem and directory as the source does
+function isBindOf(source, target, mounts) {
+  const sourceMount = getMountForPath(source, mounts);
+  const targetMount = mounts.filter((mount) => mount.mountPoint === target).pop();
+  if (!sourceMount || !targetMount) {
+    return false;
+  }
+  const root = path.posix.join(sourceMount.root, path.posix.relative(sourceMount.mountPoint, source));
+  return targetMount.device === sourceMount.device && targetMount.root === root;
 }
 
-function translateHostPath(hostPath) {
-  if (hostPath.startsWith('/mnt/wsl/')) {
-    return hostPath;
+function bindMount(source, target) {
+  if (!fs.existsSync(target)) {
+    fs.mkdirSync(target, { recursive: true });
   }
-
+  // Check if the mount point is already mounted
+  let isMounted;
   try {
-    const winPath = wslPathToWindowsPath(hostPath);
-    if (winPath.startsWith('\\\\wsl.localhost\\')) {
-      if (!hostPath.startsWith('/')) {
-        // noinspection ExceptionCaughtLocallyJS
-        throw new Error(`PODMAN WSL SERVICE BUG: unexpected path format, expected absolute path: '${hostPath}'`);
-      }
-      const res = path.join(sharedRoot, hostPath.slice(1));
-      console.debug(`Translating host path: ${hostPath} -> ${res}`);
-      return res;
-    }
-    return winPath;
+    execFileSync('mountpoint', ['-q', target]);
+    isMounted = true;
   } catch (err) {
-    console.error('Error translating host path:', err);
-    throw err;
+    isMounted = false;
   }
-}
 
-function patchVolumesLibpod(body) {
-  const mounts = body.mounts;
-  if (!Array.isArray(mounts)) {
-    return;
+  let options = `rbind,${sharedRootPropagation}`;
+  if (isMounted) {
+    options += ',remount';
   }
+  execFileSync('mount', [source, target, '-o', options]);
+}
 
-  for (let i = 0; i < mounts.length; i++) {
-    const mount = mounts[i];
-    const hostPath = mount.source;
-    try {
-      mounts[i].source = translateHostPath(hostPath);
-    } catch (err) {
-      console.error('Error mangling volumes (libpod):', err);
-      throw err;
+// The recursive bind brings along the kernel and runtime filesystems. Thanks to the slave propagation, unmounting them
+// from the shared root does not affect the distro.
+function unmountVirtualFilesystems(mountPoint) {
+  const mountPoints = readMountInfo().map((mount) => mount.mountPoint);
+  for (const dir of virtualFilesystemDirectories) {
+    const target = path.join(mountPoint, dir);
+    if (mountPoints.includes(target)) {
+      console.debug(`Unmounting ${target} from the shared root`);
+      execFileSync('umount', ['--lazy', target]);
     }
   }
 }
 
-function patchVolumesDocker(body) {
-  const mounts = body.HostConfig?.Binds;
-  if (!Array.isArray(mounts)) {
-    return;
+// Read-only bind mounts are not recursive, so every mount below the shared root is remounted on its own
+function remountReadOnly(mountPoint) {
+  const mountPoints = readMountInfo()
+    .map((mount) => mount.mountPoint)
+    .filter((target) => isSubpath(target, mountPoint));
+  for (const target of mountPoints) {
+    execFileSync('mount', ['-o', 'remount,bind,ro', target]);
   }
+}
 
-  for (let i = 0; i < mounts.length; i++) {
-    const mount = mounts[i].split(':');
-    const hostPath = mount[0];
-    try {
-      mount[0] = translateHostPath(hostPath);
-      mounts[i] = mount.join(':');
-    } catch (err) {
-      console.error('Error mangling volumes (docker):', err);
-      throw err;
-    }
+// Lazy unmounts do not fail while containers still use the shared root, the mounts go away with the last user. The
+// submounts of the recursive binds are detached along with the top-level mounts.
+function unmountSharedMountpoint(mountPoint) {
+  const mountPoints = readMountInfo()
+    .map((mount) => mount.mountPoint)
+    .filter((target) => isSubpath(target, mountPoint));
+  const topLevelMountPoints = mountPoints.filter(
+    (target) => !mountPoints.some((other) => other !== target && isSubpath(target, other))
+  );
+  for (const target of new Set(topLevelMountPoints)) {
+    console.log(`Unmounting shared mountpoint: ${target}`);
+    execFileSync('umount', ['--lazy', target]);
   }
 }
 
-async function forwardRequest(req, res, modifiedBody = null) {
-  console.log(`${res.statusCode} ${req.method} ${req.url} - intercepted: ${modifiedBody === null ? 'no' : 'yes'}`);
-  const headers = { ...req.headers };
-
-  const options = {
-    socketPath: upstreamSocketPath,
-    method: req.method,
-    headers,
-    path: req.url,
-  };
+function errorBody(statusCode, message, err) {
+  return JSON.stringify({
+    response: statusCode,
+    message: `podman-wsl-service: ${message}: ${err.message}`,
+    cause: err.message,
+  });
+}
+
+function writeError(res, statusCode, message, err) {
+  res.writeHead(statusCode, { 'Content-Type': 'application/json' });
+  res.end(errorBody(statusCode, message, err));
+}
+
+// Used for upgrade requests, where there is no response object to write to
+function writeSocketError(socket, statusCode, message, err) {
+  const body = errorBody(statusCode, message, err);
+  socket.end(
+    `HTTP/1.1 ${statusCode} ${http.STATUS_CODES[statusCode]}\r\n` +
+      'Content-Type: application/json\r\n' +
+      `Content-Length: ${Buffer.byteLength(body)}\r\n` +
+      'Connection: close\r\n\r\n' +
+      body
+  );
+}
+
+// The translate endpoint only describes what would happen to bind mounts, so it stays available in read-only mode
+function getRequestPolicyViolation(req, upgrade) {
+  const pathWithoutVersion = getPathWithoutVersion(req.url);
+  if (readOnly && !(req.method === 'POST' && pathWithoutVersion === '/_wsl/translate')) {
+    const violation = getReadOnlyViolation(req.method, upgrade);
+    if (violation) {
+      return violation;
+    }
+  }
+  return getApiPolicyViolation(apiPolicy, req.method, pathWithoutVersion);
+}
+
+// Old clients send bind mounts in ways the machine handles differently, e.g. without HostConfig.Mounts, and fail later
+// in confusing ways. Unversioned and libpod requests are let through.
+function getApiVersionViolation(req) {
+  const version = minApiVersion && getRequestedVersion(getNormalizedPath(req.url));
+  if (!version || compareVersions(version, minApiVersion) >= 0) {
+    return null;
+  }
+  return (
+    `API version ${version} is not supported, this socket requires ${minApiVersion} or later; ` +
+    `upgrade the client or set DOCKER_API_VERSION=${minApiVersion}`
+  );
+}
+
+async function getAuthorizationViolation(req) {
+  if (!allowedUids.length && !allowedGids.length) {
+    return null;
+  }
+  const cred = await getClientCredentials(req);
+  if (!cred) {
+    return 'unable to determine the client credentials';
+  }
+  if (allowedUids.includes(cred.uid) || [cred.gid, ...cred.groups].some((gid) => allowedGids.includes(gid))) {
+    return null;
+  }
+  return `user ${cred.uid} is not allowed to use this socket`;
+}
+
+// The socket of an HTTP/2 request is a proxy of the socket of its session, which cannot be used once the stream is
+// closed, e.g. by the webhooks
+function getConnection(req) {
+  if (req.stream) {
+    return req.stream.session ? req.stream.session.socket : null;
+  }
+  return req.socket;
+}
+
+// The client of a connection is looked up once, on its first request that needs it, unless turned off. The result is
+// kept on the request as well, for the lookups after its stream is closed.
+// The processes of other distros are in other PID namespaces, so their connections cannot be looked up. The requests of
+// the filter command have no connection.
+function getClientCredentials(req) {
+  if (!clientLookup || req.clientDistro) {
+    return null;
+  }
+  if (req.clientCredentials === undefined) {
+    const connection = getConnection(req);
+    req.clientCredentials = connection ? getPeerCredentials(connection) : null;
+  }
+  return req.clientCredentials;
+}
+
+function getClientDistro(req) {
+  return req.clientDistro || distroName;
+}
+
+// The policies and the interception of create requests see the path the way the upstream does: decoded and without
+// dot segments and duplicate slashes
+function getNormalizedPath(reqUrl) {
+  const pathname = url.parse(reqUrl).pathname || '/';
+  try {
+    return path.posix.normalize(decodeURIComponent(pathname));
+  } catch (err) {
+    return path.posix.normalize(pathname);
+  }
+}
+
+// Podman routes paths with any version prefix starting with a digit, e.g. /v1/, /v1.41/ or /v5.0.0/
+function getPathWithoutVersion(reqUrl) {
+  return getNormalizedPath(reqUrl).replace(/^\/v[0-9][0-9A-Za-z.-]*\//, '/');
+}
+
+const windowsPaths = new PathCache(parseFloat(options.pathCacheTtl));
+
+// wslpath is only run for mounts the mount table does not tell enough about. Failures are not cached.
+function wslPathToWindowsPath(wslPath) {
+  return windowsPaths.get(wslPath, () => {
+    const windowsPath = getWindowsPath(wslPath, distroName);
+    if (windowsPath) {
+      return windowsPath;
+    }
+    return execFileSync('wslpath', ['-aw', wslPath]).toString().trim();
+  });
+}
+
+// Root clients use the active upstream socket. Other clients, including those that cannot be identified, use the
+// rootless socket exported by the same machine if there is one.
+async function getUpstreamSocketPath(req) {
+  const active = upstreams.active;
+  if (!routeByUid) {
+    return active;
+  }
+  const cred = await getClientCredentials(req);
+  const kind = cred && cred.uid === 0 ? 'root' : 'user';
+  return getSiblingSocket(active, kind) || active;
+}
+
+// Requests for API versions newer than the upstream supports are sent with the newest one it does
+async function clampApiVersion(req) {
+  const clampedUrl = await apiVersions.clampUrl(await getUpstreamSocketPath(req), req.url);
+  if (clampedUrl !== req.url) {
+    console.debug(`Lowering the API version to the one of the upstream: ${req.url} -> ${clampedUrl}`);
+    req.url = clampedUrl;
+  }
+}
+
+// Translates the bind sources of a create request up front, so that wslpath runs once for all of them instead of once
+// per mount. translateHostPath then finds them in the cache; failures are left to it to report.
+function prefetchWindowsPaths(hostPaths) {
+  const pending = hostPaths.filter(
+    (hostPath) =>
+      typeof hostPath === 'string' &&
+      hostPath.startsWith('/') &&
+      !hostPath.startsWith('/mnt/wsl/') &&
+      !applyPathRules(pathRules, hostPath) &&
+      !windowsPaths.has(hostPath)
+  );
+  if (pending.length < 2) {
+    return;
+  }
+  try {
+    translateAll(pending, distroName).forEach((windowsPath, hostPath) => windowsPaths.set(hostPath, windowsPath));
+  } catch (err) {
+    console.debug(`Unable to translate the bind sources at once: ${err.message}`);
+  }
+}
+
+function checkSharedDirectories(hostPath) {
+  const normalized = normalizePath(hostPath);
+  if (sharedDirectories.length && !sharedDirectories.some((dir) => isSubpath(normalized, dir))) {
+    throw new ProxyError(400, `${hostPath} is not in one of the directories shared with the machine (--share-dir)`);
+  }
+}
+
+function validateBindSource(hostPath, checkPath) {
+  if (!fs.existsSync(checkPath)) {
+    throw new ProxyError(400, `bind source ${hostPath} does not exist in distro ${distroName}`);
+  }
+}
+
+// Depending on the Windows build, wslpath prints distro paths as \\wsl.localhost\<distro>\... or \\wsl$\<distro>\...
+const wslUncPrefixes = ['\\\\wsl.localhost\\', '\\\\wsl$\\'];
+
+// Returns the distro and the path inside it, or null for other paths
+function parseWslUncPath(winPath) {
+  const lowerCasePath = winPath.toLowerCase();
+  const prefix = wslUncPrefixes.find((uncPrefix) => lowerCasePath.startsWith(uncPrefix));
+  if (!prefix) {
+    return null;
+  }
+  const [distro, ...parts] = winPath.slice(prefix.length).split('\\');
+  return { distro, distroPath: `/${parts.filter(Boolean).join('/')}` };
+}
+
+// Paths of other distros are found in their shared roots, provided the service runs there as well
+function getDistroRootPath(uncPath) {
+  return path.posix.join(getSharedMountpoint(uncPath.distro), uncPath.distroPath);
+}
+
+// The mount policy applies to the files that end up mounted, however the client spells their path: the shared roots
+// and \\wsl.localhost paths are taken back to the path in the distro, Windows drive paths to their automount path, and
+// symlinks are resolved, e.g. /proc/1/root/etc to /etc. The files of other distros are not visible here, so their
+// paths are only normalized.
+function getPolicyPath(hostPath) {
+  const uncPath = parseWslUncPath(hostPath);
+  if (uncPath) {
+    return getDistroPolicyPath(uncPath.distro, uncPath.distroPath);
+  }
+  const windowsPath = parseWindowsDrivePath(hostPath);
+  if (windowsPath) {
+    return resolveRealPath(getDrivePath(windowsPath));
+  }
+  const resolved = resolveRealPath(hostPath);
+  if (resolved.startsWith(`${sharedRootDir}/`)) {
+    const [distro, ...parts] = resolved.slice(sharedRootDir.length + 1).split('/');
+    return getDistroPolicyPath(distro, `/${parts.join('/')}`);
+  }
+  return resolved;
+}
+
+function getDistroPolicyPath(distro, distroPath) {
+  if (distro.toLowerCase() === distroName.toLowerCase()) {
+    return resolveRealPath(distroPath);
+  }
+  return normalizePath(path.posix.resolve(distroPath));
+}
+
+// The client distro is given for the clients of other distros served by this one
+function translateHostPath(hostPath, clientDistro = null) {
+  const mapped = applyPathRules(pathRules, hostPath);
+  // Final rules point into the machine, so the path they were given is checked instead
+  if (mountPolicy) {
+    const policyPath = mapped && !mapped.final ? mapped.path : hostPath;
+    let resolved;
+    try {
+      resolved = getPolicyPath(clientDistro ? toDistroPath(clientDistro, policyPath) : policyPath);
+    } catch (err) {
+      const message = `bind mount source '${hostPath}' cannot be checked by the mount policy: ${err.message}`;
+      throw new MountDeniedError(message);
+    }
+    checkMountPolicy(mountPolicy, resolved, hostPath);
+  }
+
+  if (mapped) {
+    console.debug(`Path rule matched: ${hostPath} -> ${mapped.path}`);
+    if (mapped.final) {
+      return mapped.path;
+    }
+    hostPath = mapped.path;
+  }
+
+  if (clientDistro) {
+    hostPath = toDistroPath(clientDistro, hostPath);
+  }
+
+  // Windows clients may send the \\wsl.localhost path of a distro. The paths of this distro are checked like the ones
+  // found by wslpath.
+  const clientUncPath = parseWslUncPath(hostPath);
+  if (clientUncPath) {
+    const ownDistro = clientUncPath.distro.toLowerCase() === distroName.toLowerCase();
+    if (ownDistro) {
+      checkSharedDirectories(clientUncPath.distroPath);
+    }
+    const res = getDistroRootPath(clientUncPath);
+    console.debug(`Translating host path: ${hostPath} -> ${res}`);
+    if (ownDistro && validateMounts) {
+      validateBindSource(hostPath, clientUncPath.distroPath);
+    }
+    return res;
+  }
+
+  // Includes the shared roots of other distros
+  if (hostPath.startsWith('/mnt/wsl/')) {
+    if (hostPath.startsWith(`${sharedRoot}/`)) {
+      checkSharedDirectories(hostPath.slice(sharedRoot.length));
+    }
+    return hostPath;
+  }
+
+  // Windows paths sent by the client are translated like the ones from wslpath
+  const clientWindowsPath = parseWindowsDrivePath(hostPath);
+
+  // Only worth checking if the source can be copied instead
+  if (!clientWindowsPath && getTranslationFailureMode(failureModes, hostPath) === 'copy-to-volume') {
+    const mount = getMountForPath(path.resolve(hostPath));
+    if (mount && isUnshareableFilesystem(mount.fsType)) {
+      throw new Error(`${hostPath} is on a ${mount.fsType} filesystem, which cannot be shared with the machine`);
+    }
+  }
+
+  try {
+    const winPath = clientWindowsPath || wslPathToWindowsPath(hostPath);
+    const uncPath = parseWslUncPath(winPath);
+    if (uncPath && uncPath.distro.toLowerCase() !== distroName.toLowerCase()) {
+      // e.g. a mount of another distro's files
+      const res = getDistroRootPath(uncPath);
+      console.debug(`Translating host path of distro ${uncPath.distro}: ${hostPath} -> ${res}`);
+      if (validateMounts) {
+        validateBindSource(hostPath, res);
+      }
+      return res;
+    }
+    if (uncPath) {
+      if (!hostPath.startsWith('/')) {
+        // noinspection ExceptionCaughtLocallyJS
+        throw new Error(`PODMAN WSL SERVICE BUG: unexpected path format, expected absolute path: '${hostPath}'`);
+      }
+      checkSharedDirectories(hostPath);
+      const res = path.join(sharedRoot, hostPath.slice(1));
+      console.debug(`Translating host path: ${hostPath} -> ${res}`);
+      if (validateMounts) {
+        validateBindSource(hostPath, res);
+      }
+      return res;
+    }
+    const share = getShare(winPath);
+    if (share) {
+      // The machine only has the Windows drives, network shares need to be mounted in it separately
+      const machinePath = mapSharePath(shareMappings, winPath);
+      if (!machinePath) {
+        // noinspection ExceptionCaughtLocallyJS
+        throw new ProxyError(
+          400,
+          `${hostPath} is on the network share ${share}, which the machine cannot access; ` +
+            'mount the share in the machine and add it to "shareMappings", or copy the files into the distro'
+        );
+      }
+      console.debug(`Translating host path: ${hostPath} -> ${machinePath}`);
+      return machinePath;
+    }
+    if (validateMounts) {
+      validateBindSource(hostPath, clientWindowsPath ? getDrivePath(winPath) : hostPath);
+    }
+    if (mapDrives) {
+      const machinePath = mapDrivePath(driveMappings, winPath);
+      console.debug(`Translating host path: ${hostPath} -> ${machinePath}`);
+      return machinePath;
+    }
+    return winPath;
+  } catch (err) {
+    console.error('Error translating host path:', err);
+    throw err;
+  }
+}
+
+const translationStats = new TranslationStats();
+
+// Other distros are reached through their shared roots as well
+function getTranslationOutcome(translated) {
+  return isSubpath(translated, '/mnt/wsl') ? 'sharedRoot' : 'windowsPath';
+}
+
+function logTranslationSummary() {
+  translationStats.summarize().forEach((line) => console.log(line));
+}
+
+function formatBytes(bytes) {
+  const units = ['bytes', 'KiB', 'MiB', 'GiB', 'TiB'];
+  const exponent = Math.min(Math.floor(Math.log2(Math.max(bytes, 1)) / 10), units.length - 1);
+  return exponent ? `${(bytes / 1024 ** exponent).toFixed(1)} ${units[exponent]}` : `${bytes} bytes`;
+}
+
+function formatUptime(seconds) {
+  const days = Math.floor(seconds / 86400);
+  const hours = Math.floor((seconds % 86400) / 3600);
+  const minutes = Math.floor((seconds % 3600) / 60);
+  return days ? `${days}d ${hours}h` : hours ? `${hours}h ${minutes}m` : `${minutes}m`;
+}
+
+// Logged every --status-interval seconds, so the log tells whether the service is alive and in use
+function logStatus() {
+  const totals = connectionStats.getTotals();
+  const translations = Object.values(translationStats.getStats())
+    .flatMap((counts) => Object.values(counts))
+    .reduce((sum, count) => sum + count, 0);
+  console.log(
+    `Status: up ${formatUptime(process.uptime())}, upstream ${upstreams.getHealth().state}, ` +
+      `${activeConnections} active connections, ${totals.requests} requests, ${translations} translations, ` +
+      `${formatBytes(totals.bytesIn)} received, ${formatBytes(totals.bytesOut)} sent`
+  );
+}
+
+const translationFailureActions = {
+  'pass-through': 'forwarded untouched',
+  'drop-mount': 'dropped',
+  'copy-to-volume': 'copied into a volume',
+  'substitute-volume': 'replaced with an empty volume',
+};
+
+function getFailureMode(hostPath, err) {
+  if (err instanceof MountDeniedError) {
+    return mountPolicy.onDeny === 'volume' ? 'substitute-volume' : 'strict';
+  }
+  return err instanceof ProxyError ? 'strict' : getTranslationFailureMode(failureModes, hostPath);
+}
+
+// Returns the translation failure mode to apply to the mount. The files of other distros cannot be read here, so
+// their sources are not copied into volumes: the files of this distro at the same path would be copied instead.
+function handleTranslationFailure(hostPath, err, api, warnings, clientDistro = null) {
+  translationStats.record(api, err instanceof MountDeniedError ? 'excluded' : 'failed');
+  const mode = getFailureMode(hostPath, err);
+  if (mode === 'strict') {
+    console.error(`Error mangling volumes (${api}):`, err);
+    throw err;
+  }
+  if (mode === 'copy-to-volume' && clientDistro) {
+    console.error(`Error mangling volumes (${api}), not copying a source of distro ${clientDistro}:`, err);
+    throw err instanceof ProxyError ? err : new ProxyError(400, `unable to translate ${hostPath}: ${err.message}`);
+  }
+  const action = translationFailureActions[mode];
+  const reason = err instanceof MountDeniedError ? 'is denied by the mount policy' : 'could not be translated';
+  console.error(`Bind source ${hostPath} ${reason}, mount will be ${action}: ${err.message}`);
+  warnings.push(`bind source ${hostPath} ${reason} and was ${action} by podman-wsl-service`);
+  return mode;
+}
+
+function isVolumeSubstitution(mode) {
+  return mode === 'copy-to-volume' || mode === 'substitute-volume';
+}
+
+async function substituteVolume(mode, hostPath, upstreamSocketPath) {
+  const sourcePath = path.resolve(hostPath);
+  if (dryRun) {
+    return `(${mode === 'substitute-volume' ? 'new empty volume' : `copy of ${sourcePath}`})`;
+  }
+  try {
+    if (mode === 'substitute-volume') {
+      const volumeName = await createScratchVolume(upstreamSocketPath, distroName, sourcePath);
+      console.log(`Substituted volume ${volumeName} for ${hostPath}`);
+      return volumeName;
+    }
+    const volumeName = await copyDirectoryToVolume(upstreamSocketPath, distroName, sourcePath);
+    console.log(`Copied ${hostPath} into volume ${volumeName}, changes will not be synced back`);
+    return volumeName;
+  } catch (err) {
+    console.error(`Error substituting a volume for ${hostPath}:`, err);
+    if (err instanceof ProxyError) {
+      throw err;
+    }
+    throw new ProxyError(500, `unable to substitute a volume for ${hostPath}: ${err.message}`);
+  }
+}
+
+// With a read-only shared root, writable mounts would fail at runtime, so the mounts are made read-only right away
+function isReadOnlyTranslation(translated) {
+  return sharedRootReadOnly && isSubpath(translated, sharedRoot);
+}
+
+function addTranslationWarning(warnings, hostPath, translated) {
+  if (translated !== hostPath) {
+    warnings.push(`bind source ${hostPath} was translated to ${translated} by podman-wsl-service`);
+  }
+}
+
+// Containers reach the Windows drives through 9p, which is many times slower than the distro filesystem. This is
+// behind most reports of podman being slow in WSL, so it is pointed out on every create.
+function isOnWindowsDrive(hostPath, clientDistro) {
+  const distroPath = clientDistro ? toDistroPath(clientDistro, hostPath) : hostPath;
+  if (parseWindowsDrivePath(distroPath)) {
+    return true;
+  }
+  if (clientDistro || !distroPath.startsWith('/')) {
+    return false;
+  }
+  const mount = getMountForPath(path.resolve(distroPath));
+  return !!mount && isWindowsMount(mount);
+}
+
+function addDriveWarning(warnings, hostPath, clientDistro) {
+  if (!driveWarnings || !isOnWindowsDrive(hostPath, clientDistro)) {
+    return;
+  }
+  const warning =
+    `bind source ${hostPath} is on a Windows drive, where file access from containers is much slower than in the ` +
+    'distro; consider moving the files into the distro filesystem';
+  console.log(`Warning: ${warning}`);
+  warnings.push(warning);
+}
+
+// Overlay volumes ("podman run -v /src:/dst:O") have a bind source as well, which the container only sees through an
+// overlay, so they are not made read-only
+async function patchVolumesLibpod(body, warnings, upstreamSocketPath, clientDistro = null) {
+  const mounts = Array.isArray(body.mounts) ? body.mounts : [];
+  const overlays = Array.isArray(body.overlay_volumes) ? body.overlay_volumes : [];
+  if (!mounts.length && !overlays.length) {
+    return;
+  }
+
+  if (!clientDistro) {
+    prefetchWindowsPaths([...mounts, ...overlays].map((mount) => mount.source));
+  }
+  const volumes = [];
+  const patchMounts = async (list, overlay) => {
+    const patched = [];
+    for (const mount of list) {
+      const hostPath = mount.source;
+      try {
+        mount.source = translateHostPath(hostPath, clientDistro);
+        translationStats.record('libpod', getTranslationOutcome(mount.source));
+        addTranslationWarning(warnings, hostPath, mount.source);
+        addDriveWarning(warnings, hostPath, clientDistro);
+        if (!overlay && isReadOnlyTranslation(mount.source)) {
+          mount.options = (mount.options || []).filter((option) => option !== 'rw' && option !== 'ro').concat('ro');
+        }
+        patched.push(mount);
+      } catch (err) {
+        const mode = handleTranslationFailure(hostPath, err, 'libpod', warnings, clientDistro);
+        if (mode === 'pass-through') {
+          patched.push(mount);
+        } else if (isVolumeSubstitution(mode)) {
+          volumes.push({
+            Name: await substituteVolume(mode, hostPath, upstreamSocketPath),
+            Dest: mount.destination,
+            Options: (mount.options || []).filter((option) => option === 'ro' || option === 'rw'),
+          });
+        }
+      }
+    }
+    return patched;
+  };
+  if (Array.isArray(body.mounts)) {
+    body.mounts = await patchMounts(mounts, false);
+  }
+  if (Array.isArray(body.overlay_volumes)) {
+    body.overlay_volumes = await patchMounts(overlays, true);
+  }
+  if (volumes.length) {
+    body.volumes = (Array.isArray(body.volumes) ? body.volumes : []).concat(volumes);
+  }
+}
+
+// A container run from a directory of the distro ("podman run --rootfs") needs it translated like a bind source. It
+// cannot be skipped or replaced with a volume, so only the pass-through failure mode lets the request through.
+function patchRootfsLibpod(body, warnings, clientDistro = null) {
+  const hostPath = body.rootfs;
+  if (typeof hostPath !== 'string' || !hostPath) {
+    return;
+  }
+  try {
+    body.rootfs = translateHostPath(hostPath, clientDistro);
+    translationStats.record('libpod', getTranslationOutcome(body.rootfs));
+    if (body.rootfs !== hostPath) {
+      warnings.push(`rootfs ${hostPath} was translated to ${body.rootfs} by podman-wsl-service`);
+    }
+  } catch (err) {
+    if (getFailureMode(hostPath, err) !== 'pass-through') {
+      translationStats.record('libpod', err instanceof MountDeniedError ? 'excluded' : 'failed');
+      console.error('Error translating the rootfs (libpod):', err);
+      throw err;
+    }
+    handleTranslationFailure(hostPath, err, 'libpod', warnings);
+  }
+}
+
+const namespaceKeys = ['cgroupns', 'ipcns', 'netns', 'pidns', 'userns', 'utsns'];
+
+// Namespaces joined by path ("podman run --network ns:/proc/...") are files of the distro, which the machine cannot
+// open, so the request is rejected instead of failing with ENOENT on the machine
+function checkNamespacePathsLibpod(body) {
+  for (const key of namespaceKeys) {
+    const namespace = body[key];
+    if (namespace && namespace.nsmode === 'path') {
+      throw new ProxyError(
+        400,
+        `${key} joins the namespace at ${namespace.value}, which is a path in the distro and cannot be joined by the ` +
+          'podman machine'
+      );
+    }
+  }
+}
+
+// Binds are "source:destination[:options]". A source with a drive letter, e.g. C:/Users/me:/app, is told apart from a
+// volume with a one letter name by the absolute destination that follows it.
+function splitBind(bind) {
+  const parts = bind.split(':');
+  if (parts.length >= 3 && /^[A-Za-z]$/.test(parts[0]) && /^[\\/]/.test(parts[1]) && parts[2].startsWith('/')) {
+    return [`${parts[0]}:${parts[1]}`, ...parts.slice(2)];
+  }
+  return parts;
+}
+
+// The names the daemon accepts for volumes, which it creates for such a source when it does not exist yet
+const volumeNamePattern = /^[A-Za-z0-9][A-Za-z0-9_.-]*$/;
+
+// Absolute and Windows paths are always translated, a valid volume name is left to the daemon
+function isNamedVolume(source) {
+  return !source.startsWith('/') && !parseWindowsDrivePath(source) && volumeNamePattern.test(source);
+}
+
+async function patchVolumesDocker(body, warnings, upstreamSocketPath, clientDistro = null) {
+  const mounts = body.HostConfig?.Binds;
+  if (!Array.isArray(mounts)) {
+    return;
+  }
+
+  if (!clientDistro) {
+    prefetchWindowsPaths(mounts.map((bind) => splitBind(bind)[0]));
+  }
+  const patched = [];
+  for (const bind of mounts) {
+    const mount = splitBind(bind);
+    const hostPath = mount[0];
+    if (isNamedVolume(hostPath)) {
+      console.debug(`Not translating named volume: ${hostPath}`);
+      patched.push(bind);
+      continue;
+    }
+    try {
+      mount[0] = translateHostPath(hostPath, clientDistro);
+      translationStats.record('docker', getTranslationOutcome(mount[0]));
+      addTranslationWarning(warnings, hostPath, mount[0]);
+      addDriveWarning(warnings, hostPath, clientDistro);
+      if (isReadOnlyTranslation(mount[0])) {
+        // The options are the optional third part of the bind, e.g. "rw,z"
+        const bindOptions = (mount[2] || '')
+          .split(',')
+          .filter((option) => option && option !== 'rw' && option !== 'ro');
+        mount[2] = bindOptions.concat('ro').join(',');
+      }
+      patched.push(mount.join(':'));
+    } catch (err) {
+      const mode = handleTranslationFailure(hostPath, err, 'docker', warnings, clientDistro);
+      if (mode === 'pass-through') {
+        patched.push(bind);
+      } else if (isVolumeSubstitution(mode)) {
+        mount[0] = await substituteVolume(mode, hostPath, upstreamSocketPath);
+        patched.push(mount.join(':'));
+      }
+    }
+  }
+  body.HostConfig.Binds = patched;
+}
+
+// "docker run --mount type=bind" sends the bind in HostConfig.Mounts instead. The source may be a Windows path as well,
+// e.g. C:\Users\me\data passed from a WSL shell. Mounts of other types are left alone.
+async function patchMountsDocker(body, warnings, upstreamSocketPath, clientDistro = null) {
+  const mounts = body.HostConfig?.Mounts;
+  if (!Array.isArray(mounts)) {
+    return;
+  }
+
+  const isBind = (mount) => mount && mount.Type === 'bind' && typeof mount.Source === 'string';
+  if (!clientDistro) {
+    prefetchWindowsPaths(mounts.filter(isBind).map((mount) => mount.Source));
+  }
+  const patched = [];
+  for (const mount of mounts) {
+    if (!isBind(mount)) {
+      patched.push(mount);
+      continue;
+    }
+    const hostPath = mount.Source;
+    try {
+      mount.Source = translateHostPath(hostPath, clientDistro);
+      translationStats.record('docker', getTranslationOutcome(mount.Source));
+      addTranslationWarning(warnings, hostPath, mount.Source);
+      addDriveWarning(warnings, hostPath, clientDistro);
+      if (isReadOnlyTranslation(mount.Source)) {
+        mount.ReadOnly = true;
+      }
+      patched.push(mount);
+    } catch (err) {
+      const mode = handleTranslationFailure(hostPath, err, 'docker', warnings, clientDistro);
+      if (mode === 'pass-through') {
+        patched.push(mount);
+      } else if (isVolumeSubstitution(mode)) {
+        const volumeName = await substituteVolume(mode, hostPath, upstreamSocketPath);
+        patched.push({ Type: 'volume', Source: volumeName, Target: mount.Target, ReadOnly: !!mount.ReadOnly });
+      }
+    }
+  }
+  body.HostConfig.Mounts = patched;
+}
+
+async function getClientLabels(req) {
+  const labels = { 'wsl.distro': getClientDistro(req) };
+  const cred = await getClientCredentials(req);
+  if (cred) {
+    labels['wsl.user'] = cred.user;
+    labels['wsl.program'] = cred.program;
+  }
+  return labels;
+}
+
+// Docker uses "Labels", libpod uses "labels"
+function addLabels(body, key, labels) {
+  if (body[key] === null || typeof body[key] !== 'object') {
+    body[key] = {};
+  }
+  Object.assign(body[key], labels);
+}
+
+const clientHeaderNames = ['x-wsl-client-uid', 'x-wsl-client-pid', 'x-wsl-client-program', 'x-wsl-distro'];
+
+async function getClientHeaders(req) {
+  const headers = { 'X-WSL-Distro': getClientDistro(req) };
+  const cred = await getClientCredentials(req);
+  if (cred) {
+    headers['X-WSL-Client-Uid'] = String(cred.uid);
+    headers['X-WSL-Client-Pid'] = String(cred.pid);
+    headers['X-WSL-Client-Program'] = cred.program.replace(/[^\x20-\x7e]/g, '?');
+  }
+  return headers;
+}
+
+// Tells the webhooks about containers created, started or removed through the service, once the upstream succeeded
+function notifyLifecycleEvent(req, upstreamRes) {
+  const lifecycleEvent = getLifecycleEvent(req.method, getPathWithoutVersion(req.url), upstreamRes.statusCode);
+  if (!lifecycleEvent) {
+    return;
+  }
+  // The ID of a created container is only in the response
+  const chunks = [];
+  if (lifecycleEvent.event === 'create') {
+    upstreamRes.on('data', (chunk) => chunks.push(chunk));
+  }
+  upstreamRes.on('end', async () => {
+    const payload = {
+      event: lifecycleEvent.event,
+      time: new Date().toISOString(),
+      distro: getClientDistro(req),
+      container: lifecycleEvent.container,
+    };
+    if (lifecycleEvent.event === 'create') {
+      try {
+        payload.container = JSON.parse(Buffer.concat(chunks).toString()).Id;
+      } catch (err) {
+        payload.container = null;
+      }
+      payload.name = new URL(req.url, 'http://localhost').searchParams.get('name');
+      payload.mounts = req.forwardedMounts || [];
+    }
+    const cred = await getClientCredentials(req);
+    payload.client = cred ? { uid: cred.uid, user: cred.user, pid: cred.pid, command: cred.command } : null;
+    notifyWebhooks(webhooks, payload, `podman-wsl-service/${buildInfo.version}`);
+  });
+}
+
+// What create hooks know about the request besides its body
+async function getHookEnv(req, libpod) {
+  const env = {
+    PODMAN_WSL_API: libpod ? 'libpod' : 'docker',
+    PODMAN_WSL_DISTRO: getClientDistro(req),
+    PODMAN_WSL_URL: req.url,
+  };
+  const cred = await getClientCredentials(req);
+  if (cred) {
+    env.PODMAN_WSL_CLIENT_UID = String(cred.uid);
+    env.PODMAN_WSL_CLIENT_USER = cred.user;
+    env.PODMAN_WSL_CLIENT_PID = String(cred.pid);
+    env.PODMAN_WSL_CLIENT_COMMAND = cred.command;
+  }
+  return env;
+}
+
+function copyResponseHeaders(upstreamRes, res, skip = []) {
+  // Set response headers, preserving capitalization
+  upstreamRes.rawHeaders.forEach((value, index) => {
+    const name = value.toLowerCase();
+    if (
+      index % 2 === 0 &&
+      !skip.includes(name) &&
+      !hopByHopHeaders.includes(name) &&
+      !(res.stream && http2ResponseSkipHeaders.includes(name))
+    ) {
+      res.setHeader(value, upstreamRes.rawHeaders[index + 1]);
+    }
+  });
+}
+
+// Buffers a JSON create response to append the proxy's warnings to its "Warnings" array
+function forwardResponseWithWarnings(upstreamRes, res, warnings) {
+  const chunks = [];
+  upstreamRes.on('data', (chunk) => chunks.push(chunk));
+  upstreamRes.on('end', () => {
+    let body = Buffer.concat(chunks);
+    try {
+      const jsonBody = JSON.parse(body.toString());
+      jsonBody.Warnings = (Array.isArray(jsonBody.Warnings) ? jsonBody.Warnings : []).concat(warnings);
+      body = Buffer.from(JSON.stringify(jsonBody));
+    } catch (err) {
+      console.error(`Unable to add warnings to the response: ${err.message}`);
+    }
+    copyResponseHeaders(upstreamRes, res, ['content-length', 'transfer-encoding']);
+    res.setHeader('Content-Length', body.length);
+    res.writeHead(upstreamRes.statusCode);
+    res.end(body);
+  });
+  upstreamRes.on('error', (err) => {
+    console.error(`Error in upstream response: ${err.message}`);
+    res.end();
+  });
+}
+
+// With --auto-start-machine, an unavailable upstream is started instead of failing the request
+async function ensureUpstream() {
+  if (await upstreams.ensureAvailable()) {
+    return true;
+  }
+  if (!machineStarter) {
+    return false;
+  }
+  try {
+    await machineStarter.start();
+    return true;
+  } catch (err) {
+    // Already logged by the machine starter
+    return false;
+  }
+}
+
+const bodyDecoders = {
+  gzip: zlib.createGunzip,
+  'x-gzip': zlib.createGunzip,
+  deflate: zlib.createInflate,
+  br: zlib.createBrotliDecompress,
+};
+
+// Some SDKs compress JSON bodies. They are decompressed for rewriting and forwarded uncompressed.
+function createBodyDecoders(contentEncoding) {
+  const encodings = (contentEncoding || '')
+    .split(',')
+    .map((encoding) => encoding.trim().toLowerCase())
+    .filter((encoding) => encoding && encoding !== 'identity');
+  // Encodings are listed in the order they were applied
+  return encodings.reverse().map((encoding) => {
+    if (!bodyDecoders[encoding]) {
+      throw new ProxyError(415, `unsupported content encoding ${encoding}`);
+    }
+    const decoder = bodyDecoders[encoding]();
+    decoder.on('error', (err) => {
+      // The pipeline also destroys the decoder with the errors of the streams after it
+      if (err instanceof ProxyError) {
+        return;
+      }
+      err.message = `invalid ${encoding} body: ${err.message}`;
+      err.statusCode = 400;
+    });
+    return decoder;
+  });
+}
+
+function expectsContinue(req) {
+  return (req.headers['expect'] || '').toLowerCase() === '100-continue';
+}
+
+function hasRequestBody(req) {
+  if (isHttp2Request(req)) {
+    return !req.stream.endAfterHeaders;
+  }
+  return parseInt(req.headers['content-length'] || '0') > 0 || !!req.headers['transfer-encoding'];
+}
+
+const upstreamUnavailableMessage = 'Upstream server is unavailable - is the podman machine running?';
+const upstreamTimeoutMessage = 'The podman machine did not answer in time';
+const upstreamConnectErrors = ['ENOENT', 'ECONNREFUSED', 'ETIMEDOUT'];
+
+// Answers version, ping and list requests from the cache, or forwards them as usual if the upstream cannot be asked
+async function serveCachedResponse(req, res) {
+  let upstreamRes;
+  try {
+    const upstreamSocketPath = await getUpstreamSocketPath(req);
+    upstreamRes = await responseCache.get(upstreamSocketPath, req.method, req.url, getPathWithoutVersion(req.url));
+  } catch (err) {
+    console.debug(`Unable to cache ${req.url}: ${err.message}`);
+    await forwardRequest(req, res);
+    return;
+  }
+  console.log(`${upstreamRes.statusCode} ${req.method} ${req.url} - cached: ${upstreamRes.cached ? 'yes' : 'no'}`);
+  res.writeHead(upstreamRes.statusCode, upstreamRes.headers);
+  res.end(req.method === 'HEAD' ? undefined : upstreamRes.body);
+}
+
+// Responses of these endpoints last as long as there is something to follow, or carry large archives
+const streamingPathPattern = new RegExp(
+  '^(?:/libpod)?(?:/events|/build|/images/(?:create|pull|load|get|[^/]+/(?:push|get))|/exec/[^/]+/start|' +
+    '/containers/(?:stats|[^/]+/(?:attach|logs|stats|wait|export|archive)))$'
+);
+
+// Aborts requests to a wedged upstream with 504, unless they are streaming ones
+function setUpstreamTimeouts(req, res, upstreamReq) {
+  if (streamingPathPattern.test(getPathWithoutVersion(req.url))) {
+    return;
+  }
+  const timers = [];
+  const abort = (what, timeout) => {
+    const err = new ProxyError(504, `no ${what} from the upstream within ${timeout} seconds`);
+    upstreamReq.destroy(err);
+    if (res.headersSent) {
+      res.destroy(err);
+    }
+  };
+  if (upstreamTimeouts.header > 0) {
+    const timer = setTimeout(() => abort('response', upstreamTimeouts.header), upstreamTimeouts.header * 1000);
+    upstreamReq.once('response', () => clearTimeout(timer));
+    timers.push(timer);
+  }
+  if (upstreamTimeouts.request > 0) {
+    timers.push(
+      setTimeout(() => abort('complete response', upstreamTimeouts.request), upstreamTimeouts.request * 1000)
+    );
+  }
+  res.on('close', () => timers.forEach((timer) => clearTimeout(timer)));
+}
+
+// Containers created through the service, so that their events can be attributed to the distro
+const createdContainers = new ContainerTracker([distroName, ...servedDistros]);
+const eventMonitor = monitorEvents ? new EventMonitor(() => upstreams.active, createdContainers) : null;
+
+function isContainerCreate(req) {
+  const pathWithoutVersion = getPathWithoutVersion(req.url);
+  return (
+    req.method === 'POST' &&
+    (pathWithoutVersion === '/containers/create' || pathWithoutVersion === '/libpod/containers/create')
+  );
+}
+
+// The ID of a created container is only in the response
+function trackCreatedContainer(req, upstreamRes) {
+  const chunks = [];
+  upstreamRes.on('data', (chunk) => chunks.push(chunk));
+  upstreamRes.on('end', () => {
+    try {
+      createdContainers.add(JSON.parse(Buffer.concat(chunks).toString()).Id, getClientDistro(req));
+    } catch (err) {
+      // Nothing to track
+    }
+  });
+}
+
+function isEventStream(req) {
+  const pathWithoutVersion = getPathWithoutVersion(req.url);
+  return req.method === 'GET' && (pathWithoutVersion === '/events' || pathWithoutVersion === '/libpod/events');
+}
+
+// Event streams are JSON documents separated by newlines, and clients skip the whitespace between them. Writing a
+// newline while no events come in keeps proxies and NAT from dropping idle watchers, and notices dead clients.
+function keepEventStreamAlive(upstreamRes, res) {
+  if (!(eventsHeartbeat > 0)) {
+    return;
+  }
+  let idle = true;
+  upstreamRes.on('data', () => (idle = false));
+  const timer = setInterval(() => {
+    if (idle) {
+      res.write('\n');
+    }
+    idle = true;
+  }, eventsHeartbeat * 1000);
+  res.on('close', () => clearInterval(timer));
+}
+
+async function forwardRequest(req, res, modifiedBody = null, warnings = []) {
+  console.log(`${res.statusCode} ${req.method} ${req.url} - intercepted: ${modifiedBody === null ? 'no' : 'yes'}`);
+  // The upstream speaks HTTP/1.1, so HTTP/2 requests are translated
+  const headers = isHttp2Request(req) ? getHttp1Headers(req) : { ...req.headers };
+  // The upstream connection is pooled, so the client's connection handling does not apply to it
+  hopByHopHeaders.forEach((name) => delete headers[name]);
+  if (forwardClientHeaders) {
+    // Never forward identity headers sent by the client itself
+    clientHeaderNames.forEach((name) => delete headers[name]);
+    Object.assign(headers, await getClientHeaders(req));
+  }
+
+  // Short-lived clients may be gone by the time the response is in, so the webhooks look up the client right away
+  if (webhooks.length) {
+    getClientCredentials(req);
+  }
+
+  const upstreamSocketPath = await getUpstreamSocketPath(req);
+  const options = {
+    ...parseUpstreamAddress(upstreamSocketPath),
+    agent: upstreamAgent,
+    method: req.method,
+    headers,
+    path: req.url,
+  };
 
   if (modifiedBody) {
-    options.headers['Content-Length'] = Buffer.byteLength(modifiedBody);
+    // The rewritten body is streamed uncompressed and chunked, however the client sent it
+    delete headers['content-length'];
+    delete headers['transfer-encoding'];
+    delete headers['content-encoding'];
+    delete headers['expect'];
+    headers['Transfer-Encoding'] = 'chunked';
+  } else if (hasRequestBody(req) && !headers['content-length'] && !headers['transfer-encoding']) {
+    // HTTP/2 bodies have no framing header, stream them chunked
+    headers['Transfer-Encoding'] = 'chunked';
   }
 
   const upstreamReq = http.request(options, (upstreamRes) => {
-    // Set response headers, preserving capitalization
-    upstreamRes.rawHeaders.forEach((value, index) => {
-      if (index % 2 === 0) {
-        const headerName = value;
-        const headerValue = upstreamRes.rawHeaders[index + 1];
-        res.setHeader(headerName, headerValue);
-      }
-    }); // Write the status code and flush headers immediately
+    if (req.method !== 'GET' && req.method !== 'HEAD') {
+      responseCache.clearLists();
+    }
+    if (webhooks.length) {
+      notifyLifecycleEvent(req, upstreamRes);
+    }
+    if ((labelContainers || eventMonitor) && upstreamRes.statusCode === 201 && isContainerCreate(req)) {
+      trackCreatedContainer(req, upstreamRes);
+    }
+    if (warnings.length && upstreamRes.statusCode === 201) {
+      forwardResponseWithWarnings(upstreamRes, res, warnings);
+      return;
+    }
+
+    copyResponseHeaders(upstreamRes, res); // Write the status code and flush headers immediately
 
     res.writeHead(upstreamRes.statusCode);
     res.flushHeaders(); // Handle data manually
 
-    upstreamRes.on('data', (chunk) => {
+    let body = upstreamRes;
+    if (upstreamRes.statusCode === 200 && isEventStream(req)) {
+      keepEventStreamAlive(upstreamRes, res);
+      if (labelContainers && !upstreamRes.headers['content-encoding']) {
+        body = upstreamRes.pipe(new EventStreamRewriter((event) => createdContainers.annotate(event)));
+      }
+    }
+
+    body.on('data', (chunk) => {
       const writeSuccess = res.write(chunk);
       if (!writeSuccess) {
-        upstreamRes.pause();
+        body.pause();
       }
     });
 
     res.on('drain', () => {
-      upstreamRes.resume();
+      body.resume();
     });
 
-    upstreamRes.on('end', () => {
+    body.on('end', () => {
       res.end();
     });
 
@@ -256,94 +2186,517 @@ async function forwardRequest(req, res, modifiedBody = null) {
     });
   });
 
-  upstreamReq.on('error', (err) => {
-    console.error(`Error proxying request: ${err.message}`);
+  upstreamReq.on('socket', (socket) => setConnectTimeout(socket, upstreamTimeouts.connect * 1000));
+  setUpstreamTimeouts(req, res, upstreamReq);
+
+  let bodyError = null;
+  upstreamReq.on('error', (err) => {
+    if (bodyError) {
+      // The request was aborted because the body could not be rewritten, and the client was told why
+      return;
+    }
+    console.error(`Error proxying request: ${err.message}`);
+    var code, message;
+    if (upstreamConnectErrors.includes(err.code)) {
+      upstreams.reportFailure(upstreamSocketPath);
+      code = 503;
+      message = upstreamUnavailableMessage;
+      err = getUnavailableError(err, upstreamSocketPath);
+    } else if (err.statusCode === 504) {
+      code = 504;
+      message = upstreamTimeoutMessage;
+    } else {
+      code = 502;
+      message = 'Error proxying request';
+    }
+
+    if (!res.headersSent) {
+      writeError(res, code, message, err);
+    } else {
+      // Appending the error would corrupt the body, so the client is only told that the response is incomplete
+      res.destroy(err);
+    }
+  });
+
+  if (modifiedBody) {
+    // Rewriting fails e.g. for invalid JSON or untranslatable paths, possibly after part of the body was sent. The
+    // upstream request is aborted then, so the incomplete body is never processed.
+    const onBodyError = (err) => {
+      bodyError = err;
+      console.error('Error processing request body:', err);
+      if (!res.headersSent) {
+        writeError(res, err.statusCode || 500, 'Error processing request body', err);
+      }
+      upstreamReq.destroy(err);
+    };
+    if (modifiedBody.errored) {
+      onBodyError(modifiedBody.errored);
+    } else {
+      modifiedBody.on('error', onBodyError);
+      modifiedBody.pipe(upstreamReq);
+    }
+  } else if (expectsContinue(req)) {
+    // Let the upstream decide whether the client should send the body. If it answers with a final status instead, the
+    // response is forwarded and the body is never sent.
+    upstreamReq.flushHeaders();
+    upstreamReq.on('continue', () => {
+      res.writeContinue();
+      req.pipe(upstreamReq);
+    });
+  } else if (hasRequestBody(req)) {
+    // If the request has a body, pipe it
+    req.pipe(upstreamReq);
+  } else {
+    // If no body, just end the upstream request
+    upstreamReq.end();
+  } // Handle client request errors
+
+  req.on('aborted', () => {
+    console.log(`Client request aborted: ${req.url}`);
+    upstreamReq.abort();
+  });
+
+  req.on('error', (err) => {
+    console.error(`Error in client request: ${err.message}`);
+    upstreamReq.abort();
+  });
+}
+
+// Read-only endpoints describing the service, e.g. for monitoring
+const serviceInfoEndpoints = {
+  '/_wsl/version': () => buildInfo,
+  '/_wsl/config': getEffectiveConfig,
+  '/_wsl/distro': getDistroInfo,
+  '/_wsl/upstream': () => upstreams.getHealth(),
+  '/_wsl/connections': () => connectionStats.getSnapshot(),
+};
+
+// These show how the service is set up, or change it. On a TCP listener without client certificates any process of the
+// machine may connect, so they are only served on the Unix sockets and to clients with a verified certificate.
+const privateServiceEndpoints = [
+  '/_wsl/config',
+  '/_wsl/distro',
+  '/_wsl/upstream',
+  '/_wsl/connections',
+  '/_wsl/health',
+  '/_wsl/log-level',
+  '/_wsl/mock/requests',
+];
+
+function isTrustedConnection(req) {
+  return !req.socket || !req.socket.remoteAddress || req.socket.authorized === true;
+}
+
+const serviceEndpoints = [
+  '/_wsl/health',
+  '/_wsl/healthz',
+  '/_wsl/readyz',
+  '/_wsl/log-level',
+  '/_wsl/translate',
+  ...Object.keys(serviceInfoEndpoints),
+  ...(mockUpstream ? ['/_wsl/mock/requests'] : []),
+];
+
+// Webhook URLs may carry credentials, so only their origins are shown
+function getEffectiveConfig() {
+  const origins = (urls) => (Array.isArray(urls) ? urls.map((url) => new URL(url).origin) : urls);
+  return {
+    configFile: options.config,
+    options: { ...options, webhook: origins(options.webhook) },
+    config: config.webhooks ? { ...config, webhooks: origins(config.webhooks) } : config,
+  };
+}
+
+function getDistroInfo() {
+  return {
+    name: distroName,
+    sharedRoot,
+    sharedRootDir,
+    mounted: mountDistroRoot && isSharedMountpointMounted(),
+    sharedDirectories,
+    readOnly: sharedRootReadOnly,
+    propagation: sharedRootPropagation,
+    automountRoot,
+    servedDistros: servedDistros.map((name) => ({ name, sharedRoot: getSharedMountpoint(name) })),
+  };
+}
+
+// Small JSON bodies of the service endpoints, which are read in full
+const maxEndpointBodySize = 1024 * 1024;
+
+function readJsonBody(req) {
+  return new Promise((resolve, reject) => {
+    const chunks = [];
+    let size = 0;
+    req.on('data', (chunk) => {
+      size += chunk.length;
+      if (size > maxEndpointBodySize) {
+        req.destroy();
+        reject(new Error(`the body is larger than ${maxEndpointBodySize} bytes`));
+        return;
+      }
+      chunks.push(chunk);
+    });
+    req.on('end', () => {
+      try {
+        resolve(JSON.parse(Buffer.concat(chunks).toString()));
+      } catch (err) {
+        reject(new Error(`the body is not valid JSON: ${err.message}`));
+      }
+    });
+    req.on('error', reject);
+  });
+}
+
+// Lets client tooling, e.g. IDE plugins, find out what bind sources become on the machine before creating a container.
+// The sources are translated as for create requests on this socket, so other distros get their own shared root.
+async function handleTranslateEndpoint(req, res) {
+  if (req.method !== 'POST') {
+    console.log(`405 ${req.method} ${req.url} - method not allowed`);
+    res.setHeader('Allow', 'POST');
+    writeError(res, 405, 'Method not allowed', new Error('POST a JSON object with the paths to translate'));
+    return;
+  }
+  let paths;
+  try {
+    const body = await readJsonBody(req);
+    paths = body && body.paths;
+    if (!Array.isArray(paths) || !paths.every((hostPath) => typeof hostPath === 'string' && hostPath)) {
+      // noinspection ExceptionCaughtLocallyJS
+      throw new Error('expected a JSON object with "paths", a list of paths');
+    }
+  } catch (err) {
+    console.log(`400 ${req.method} ${req.url} - invalid body`);
+    writeError(res, 400, 'Invalid request body', err);
+    return;
+  }
+  if (!req.clientDistro) {
+    prefetchWindowsPaths(paths);
+  }
+  const results = paths.map((hostPath) => describeTranslation(hostPath, req.clientDistro));
+  console.log(`200 ${req.method} ${req.url} - ${results.length} paths translated`);
+  res.writeHead(200, { 'Content-Type': 'application/json' });
+  res.end(JSON.stringify({ paths: results }));
+}
+
+async function handleServiceEndpoint(req, res, pathWithoutVersion) {
+  if (privateServiceEndpoints.includes(pathWithoutVersion) && !isTrustedConnection(req)) {
+    console.log(`403 ${req.method} ${req.url} - service endpoint not available over TCP`);
+    writeError(res, 403, 'Access denied', new Error('this endpoint is only served on the Unix sockets'));
+    return;
+  }
+
+  if (pathWithoutVersion === '/_wsl/translate') {
+    await handleTranslateEndpoint(req, res);
+    return;
+  }
+
+  if (mockUpstream && pathWithoutVersion === '/_wsl/mock/requests') {
+    console.log(`200 ${req.method} ${req.url} - ${mockUpstream.requests.length} recorded requests`);
+    if (req.method === 'DELETE') {
+      mockUpstream.requests = [];
+    }
+    res.writeHead(200, { 'Content-Type': 'application/json' });
+    res.end(JSON.stringify(req.method === 'DELETE' ? [] : mockUpstream.requests));
+    return;
+  }
+
+  if (pathWithoutVersion === '/_wsl/log-level') {
+    const level = new URL(req.url, 'http://localhost').searchParams.get('level');
+    if (req.method === 'PUT' || req.method === 'POST') {
+      if (!logLevels.includes(level)) {
+        console.log(`400 ${req.method} ${req.url} - invalid log level`);
+        writeError(res, 400, 'Invalid log level', new Error(`the level must be one of ${logLevels.join(', ')}`));
+        return;
+      }
+      setLogLevel(level);
+    }
+    console.log(`200 ${req.method} ${req.url} - log level ${logLevel}`);
+    res.writeHead(200, { 'Content-Type': 'application/json' });
+    res.end(JSON.stringify({ level: logLevel }));
+    return;
+  }
+
+  // Answered by the proxy itself, so health checks can tell a proxy that is down from a machine that is
+  if (pathWithoutVersion === '/_wsl/healthz') {
+    console.debug(`200 ${req.method} ${req.url} - proxy alive`);
+    res.writeHead(200, { 'Content-Type': 'text/plain' });
+    res.end('ok\n');
+    return;
+  }
+
+  // Pings the upstream the request would be forwarded to right away, instead of reporting the last health check
+  if (pathWithoutVersion === '/_wsl/readyz') {
+    const upstreamSocketPath = await getUpstreamSocketPath(req);
+    try {
+      await pingUpstream(upstreamSocketPath, 5000);
+    } catch (err) {
+      const cause = getUnavailableError(err, upstreamSocketPath).message;
+      console.log(`503 ${req.method} ${req.url} - upstream unavailable: ${cause}`);
+      res.writeHead(503, { 'Content-Type': 'text/plain' });
+      res.end(`upstream unavailable: ${cause}\n`);
+      return;
+    }
+    console.debug(`200 ${req.method} ${req.url} - upstream ready`);
+    res.writeHead(200, { 'Content-Type': 'text/plain' });
+    res.end('ok\n');
+    return;
+  }
+
+  if (pathWithoutVersion === '/_wsl/health') {
+    const health = {
+      ...upstreams.getHealth(),
+      pathCache: windowsPaths.getStats(),
+      translations: translationStats.getStats(),
+      ...(eventMonitor ? { containerEvents: eventMonitor.getStats() } : {}),
+    };
+    const statusCode = upstreams.available ? 200 : 503;
+    console.log(`${statusCode} ${req.method} ${req.url} - upstream ${health.state}`);
+    res.writeHead(statusCode, { 'Content-Type': 'application/json' });
+    res.end(JSON.stringify(health));
+    return;
+  }
+
+  const info = serviceInfoEndpoints[pathWithoutVersion];
+  if (info || pathWithoutVersion === '/_wsl' || pathWithoutVersion === '/_wsl/') {
+    console.log(`200 ${req.method} ${req.url} - service info`);
+    res.writeHead(200, { 'Content-Type': 'application/json' });
+    res.end(JSON.stringify(info ? await info() : { endpoints: serviceEndpoints }));
+    return;
+  }
+
+  console.log(`404 ${req.method} ${req.url} - unknown service endpoint`);
+  const err = new Error(`${pathWithoutVersion} is not one of ${serviceEndpoints.join(', ')}`);
+  writeError(res, 404, 'Unknown service endpoint', err);
+}
+
+const sleep = (ms) => new Promise((resolve) => setTimeout(resolve, ms));
+
+// Resolves to false if the injected fault answered the request or dropped its connection
+async function injectFault(req, res) {
+  const fault = pickFault(faults);
+  if (fault === 'latency') {
+    console.log(`Injected fault: ${req.method} ${req.url} delayed by ${faults.latency}ms`);
+    await sleep(faults.latency);
+  } else if (fault === 'drop') {
+    console.log(`Injected fault: ${req.method} ${req.url} connection dropped`);
+    resetResponse(res);
+    return false;
+  } else if (fault === 'error') {
+    const statusCode = pickErrorStatusCode();
+    console.log(`${statusCode} ${req.method} ${req.url} - injected fault`);
+    writeError(res, statusCode, 'Injected fault', new Error('the service is injecting faults (--fault-rate)'));
+    return false;
+  } else if (fault === 'reset') {
+    console.log(`Injected fault: ${req.method} ${req.url} reset after the first chunk`);
+    resetAfterFirstChunk(res);
+  }
+  return true;
+}
+
+// Attach and exec sessions are reset once they ran for the latency of the faults
+async function injectUpgradeFault(req, socket) {
+  const fault = pickFault(faults);
+  if (fault === 'latency') {
+    console.log(`Injected fault: ${req.method} ${req.url} delayed by ${faults.latency}ms`);
+    await sleep(faults.latency);
+  } else if (fault === 'drop') {
+    console.log(`Injected fault: ${req.method} ${req.url} connection dropped`);
+    socket.destroy();
+    return false;
+  } else if (fault === 'error') {
+    const statusCode = pickErrorStatusCode();
+    console.log(`${statusCode} ${req.method} ${req.url} - injected fault`);
+    writeSocketError(socket, statusCode, 'Injected fault', new Error('the service is injecting faults (--fault-rate)'));
+    return false;
+  } else if (fault === 'reset') {
+    console.log(`Injected fault: ${req.method} ${req.url} reset after ${faults.latency}ms`);
+    setTimeout(() => socket.destroy(), faults.latency);
+  }
+  return true;
+}
 
-    var code, message;
-    if (err.code === 'ENOENT') {
-      code = 502;
-      message = 'Upstream server not found - is Podman running?';
-    } else {
-      code = 500;
-      message = 'Error proxying request';
+// The streams that translate the body of a container create request, shared by the proxy and the filter command
+// Podman decodes the body case-insensitively, so e.g. {"hostConfig":{"binds":[...]}} must not get past the policy and
+// the translation. The top-level members are taken care of by the JsonRewriter.
+function canonicalizeCreateBody(members, libpod) {
+  if (libpod) {
+    for (const mount of Array.isArray(members.mounts) ? members.mounts : []) {
+      canonicalizeKeys(mount, ['type', 'source', 'destination', 'options']);
     }
-
-    if (!res.headersSent) {
-      writeError(res, code, message, err);
-    } else {
-      res.end(message);
+    for (const overlay of Array.isArray(members.overlay_volumes) ? members.overlay_volumes : []) {
+      canonicalizeKeys(overlay, ['source', 'destination', 'options']);
     }
-  });
-
-  if (modifiedBody) {
-    upstreamReq.write(modifiedBody);
-    upstreamReq.end();
-  } else if (parseInt(req.headers['content-length'] || '0') > 0 || req.headers['transfer-encoding']) {
-    // If the request has a body, pipe it
-    req.pipe(upstreamReq);
-  } else {
-    // If no body, just end the upstream request
-    upstreamReq.end();
-  } // Handle client request errors
+    namespaceKeys.forEach((key) => canonicalizeKeys(members[key], ['nsmode', 'value']));
+    return;
+  }
+  canonicalizeKeys(members.HostConfig, ['Binds', 'Mounts']);
+  for (const mount of Array.isArray(members.HostConfig?.Mounts) ? members.HostConfig.Mounts : []) {
+    canonicalizeKeys(mount, ['Type', 'Source', 'Target', 'ReadOnly']);
+  }
+}
 
-  req.on('aborted', () => {
-    console.log(`Client request aborted: ${req.url}`);
-    upstreamReq.abort();
-  });
+// The mounts of HostConfig.Mounts ("docker run --mount") are listed like the ones in Binds
+function getForwardedMountsDocker(hostConfig) {
+  const binds = Array.isArray(hostConfig?.Binds) ? hostConfig.Binds : [];
+  const mounts = (Array.isArray(hostConfig?.Mounts) ? hostConfig.Mounts : [])
+    .filter((mount) => mount && (mount.Type === 'bind' || mount.Type === 'volume') && mount.Source)
+    .map((mount) => `${mount.Source}:${mount.Target}${mount.ReadOnly ? ':ro' : ''}`);
+  return [...binds, ...mounts];
+}
 
-  req.on('error', (err) => {
-    console.error(`Error in client request: ${err.message}`);
-    upstreamReq.abort();
-  });
+async function createBodyFilters(req, warnings) {
+  const libpod = getPathWithoutVersion(req.url) === '/libpod/containers/create';
+  const labels = labelContainers ? await getClientLabels(req) : null;
+  const upstreamSocketPath = await getUpstreamSocketPath(req);
+  // Only the members that are rewritten are buffered, the rest of the body is streamed to the upstream
+  const rewriter = new JsonRewriter(
+    libpod ? ['mounts', 'overlay_volumes', 'volumes', 'rootfs', 'labels', ...namespaceKeys] : ['HostConfig', 'Labels'],
+    async (members) => {
+      canonicalizeCreateBody(members, libpod);
+      // A dry run translates a copy of the mounts and only logs what it would do
+      const patched = dryRun ? structuredClone(members) : members;
+      try {
+        if (libpod) {
+          checkNamespacePathsLibpod(patched);
+          await patchVolumesLibpod(patched, warnings, upstreamSocketPath, req.clientDistro);
+          patchRootfsLibpod(patched, warnings, req.clientDistro);
+        } else {
+          await patchVolumesDocker(patched, warnings, upstreamSocketPath, req.clientDistro);
+          await patchMountsDocker(patched, warnings, upstreamSocketPath, req.clientDistro);
+        }
+      } catch (err) {
+        if (!dryRun) {
+          throw err;
+        }
+        warnings.push(`the request would be rejected: ${err.message}`);
+      }
+      if (dryRun) {
+        warnings.forEach((warning) => console.log(`Dry run: ${warning}`));
+        warnings.length = 0;
+      }
+      if (labels) {
+        addLabels(members, libpod ? 'labels' : 'Labels', labels);
+      }
+      // For the webhooks
+      req.forwardedMounts = libpod ? members.mounts || [] : getForwardedMountsDocker(members.HostConfig);
+      return members;
+    }
+  );
+  // Hooks see the body as it would be forwarded, after the rewriting
+  const hookRunners = createHooks.length ? [new CreateHookRunner(createHooks, await getHookEnv(req, libpod))] : [];
+  return [rewriter, ...hookRunners];
 }
 
-// Create an HTTP server that listens on a Unix socket
-const server = http.createServer(async (req, res) => {
+async function handleRequest(req, res) {
+  // Included in bug reports along with the response headers
+  res.setHeader('X-Podman-WSL-Service-Version', `${buildInfo.version} (${buildInfo.commit})`);
+  // With debug logging, the client of every connection is logged, not only of the ones that need it
+  if (logLevel === 'debug') {
+    getClientCredentials(req);
+  }
   activeConnections++;
+  connectionStats.add(req, res);
   if (shutdownTimer) {
     clearTimeout(shutdownTimer);
     shutdownTimer = null;
   }
 
-  res.on('finish', () => {
+  // 'close' is also emitted when the client goes away before the response is finished
+  res.on('close', () => {
     activeConnections--;
     if (activeConnections === 0) {
       resetShutdownTimer();
     }
   });
 
-  const parsedUrl = url.parse(req.url);
-  const pathWithoutVersion = parsedUrl.pathname.replace(/^\/v\d+\.(?:\d\.?)+\//, '/');
+  if (isOverConnectionLimit()) {
+    console.log(`503 ${req.method} ${req.url} - too many connections`);
+    writeError(res, 503, connectionLimitMessage, new Error(`more than ${maxConnections} active connections`));
+    return;
+  }
+
+  const pathWithoutVersion = getPathWithoutVersion(req.url);
 
-  if (
-    req.method === 'POST' &&
-    (pathWithoutVersion === '/containers/create' || pathWithoutVersion === '/libpod/containers/create')
-  ) {
-    let body = '';
-    req.on('data', (chunk) => {
-      body += chunk;
-    });
-    req.on('end', async () => {
+  const policyViolation = getRequestPolicyViolation(req, false);
+  if (policyViolation) {
+    console.log(`403 ${req.method} ${req.url} - blocked by policy: ${policyViolation}`);
+    writeError(res, 403, 'Request blocked by policy', new Error(policyViolation));
+    return;
+  }
+
+  const authorizationViolation = await getAuthorizationViolation(req);
+  if (authorizationViolation) {
+    console.log(`403 ${req.method} ${req.url} - unauthorized: ${authorizationViolation}`);
+    writeError(res, 403, 'Access denied', new Error(authorizationViolation));
+    return;
+  }
+
+  const apiVersionViolation = getApiVersionViolation(req);
+  if (apiVersionViolation) {
+    console.log(`400 ${req.method} ${req.url} - API version too old`);
+    writeError(res, 400, 'Client API version too old', new Error(apiVersionViolation));
+    return;
+  }
+
+  // The /_wsl/ prefix is reserved for the endpoints of the service itself
+  if (pathWithoutVersion === '/_wsl' || pathWithoutVersion.startsWith('/_wsl/')) {
+    await handleServiceEndpoint(req, res, pathWithoutVersion);
+    return;
+  }
+
+  if (faults && !(await injectFault(req, res))) {
+    return;
+  }
+
+  if (!(await ensureUpstream())) {
+    console.log(`503 ${req.method} ${req.url} - upstream unavailable`);
+    writeError(res, 503, upstreamUnavailableMessage, getUnavailableError(new Error('no upstream socket is answering')));
+    return;
+  }
+
+  await clampApiVersion(req);
+
+  if (responseCache.isCacheable(req.method, pathWithoutVersion)) {
+    await serveCachedResponse(req, res);
+    return;
+  }
+
+  if (isContainerCreate(req)) {
+    if (maxBodySize > 0) {
       try {
-        const jsonBody = JSON.parse(body);
-        if (pathWithoutVersion === '/containers/create') {
-          patchVolumesDocker(jsonBody);
-        } else if (pathWithoutVersion === '/libpod/containers/create') {
-          patchVolumesLibpod(jsonBody);
-        }
-        await forwardRequest(req, res, JSON.stringify(jsonBody));
+        checkContentLength(req.headers, maxBodySize);
       } catch (err) {
-        console.error('Error processing request body:', err);
-        writeError(res, 500, 'Error processing request body', err);
+        console.log(`413 ${req.method} ${req.url} - body too large`);
+        writeError(res, 413, 'Error processing request body', err);
+        return;
       }
-    });
+    }
+    // The body is needed for rewriting, so the client can send it right away
+    if (expectsContinue(req)) {
+      res.writeContinue();
+    }
+    const warnings = [];
+    let body;
+    try {
+      const filters = await createBodyFilters(req, warnings);
+      const limits = maxBodySize > 0 ? [new BodySizeLimit(maxBodySize)] : [];
+      // Errors are handled by forwardRequest through the rewriter
+      body = pipeline(req, ...createBodyDecoders(req.headers['content-encoding']), ...limits, ...filters, () => {});
+    } catch (err) {
+      console.error('Error processing request body:', err);
+      writeError(res, err.statusCode || 500, 'Error processing request body', err);
+      return;
+    }
+    await forwardRequest(req, res, body, apiWarnings ? warnings : []);
   } else {
     await forwardRequest(req, res);
   }
-});
+}
 
-server.on('upgrade', (req, socket, head) => {
+async function handleUpgrade(req, socket, head) {
   activeConnections++;
+  const stats = connectionStats.add(req, socket);
   if (shutdownTimer) {
     clearTimeout(shutdownTimer);
     shutdownTimer = null;
@@ -356,21 +2709,89 @@ server.on('upgrade', (req, socket, head) => {
     }
   });
 
-  console.log(`101 ${req.method} ${req.url} - WebSocket upgrade`);
-  const upstreamSocket = net.connect(upstreamSocketPath, () => {
+  if (isOverConnectionLimit()) {
+    console.log(`503 ${req.method} ${req.url} - too many connections`);
+    writeSocketError(socket, 503, connectionLimitMessage, new Error(`more than ${maxConnections} active connections`));
+    return;
+  }
+
+  const policyViolation = getRequestPolicyViolation(req, true);
+  if (policyViolation) {
+    console.log(`403 ${req.method} ${req.url} - blocked by policy: ${policyViolation}`);
+    writeSocketError(socket, 403, 'Request blocked by policy', new Error(policyViolation));
+    return;
+  }
+
+  const authorizationViolation = await getAuthorizationViolation(req);
+  if (authorizationViolation) {
+    console.log(`403 ${req.method} ${req.url} - unauthorized: ${authorizationViolation}`);
+    writeSocketError(socket, 403, 'Access denied', new Error(authorizationViolation));
+    return;
+  }
+
+  const apiVersionViolation = getApiVersionViolation(req);
+  if (apiVersionViolation) {
+    console.log(`400 ${req.method} ${req.url} - API version too old`);
+    writeSocketError(socket, 400, 'Client API version too old', new Error(apiVersionViolation));
+    return;
+  }
+
+  if (faults && !(await injectUpgradeFault(req, socket))) {
+    return;
+  }
+
+  if (!(await ensureUpstream())) {
+    console.log(`503 ${req.method} ${req.url} - upstream unavailable`);
+    const err = getUnavailableError(new Error('no upstream socket is answering'));
+    writeSocketError(socket, 503, upstreamUnavailableMessage, err);
+    return;
+  }
+
+  await clampApiVersion(req);
+
+  const clientHeaders = forwardClientHeaders ? await getClientHeaders(req) : {};
+
+  // Besides attach and exec (tcp) and WebSockets, BuildKit sessions (/session and /grpc) upgrade to h2c
+  console.log(`101 ${req.method} ${req.url} - ${req.headers.upgrade} upgrade`);
+  stats.hijacked = true;
+  const startTime = Date.now();
+  let requestLength = 0;
+  const upstreamSocketPath = await getUpstreamSocketPath(req);
+  const connectOptions = { highWaterMark: streamBufferSize, connectTimeout: upstreamTimeouts.connect * 1000 };
+  const upstreamSocket = connectUpstream(upstreamSocketPath, connectOptions, () => {
     let headers = `${req.method} ${req.url} HTTP/${req.httpVersion}\r\n`;
     for (let i = 0; i < req.rawHeaders.length; i += 2) {
+      if (forwardClientHeaders && clientHeaderNames.includes(req.rawHeaders[i].toLowerCase())) {
+        continue;
+      }
       headers += `${req.rawHeaders[i]}: ${req.rawHeaders[i + 1]}\r\n`;
     }
+    for (const [name, value] of Object.entries(clientHeaders)) {
+      headers += `${name}: ${value}\r\n`;
+    }
     headers += '\r\n';
+    requestLength = Buffer.byteLength(headers);
     upstreamSocket.write(headers);
     upstreamSocket.write(head);
     socket.pipe(upstreamSocket).pipe(socket);
   });
 
+  // The client socket sees the traffic of both directions
+  if (streamIdleTimeout > 0) {
+    socket.setTimeout(streamIdleTimeout * 60 * 1000, () => {
+      console.log(`    Closing idle stream after ${streamIdleTimeout} minutes - ${req.method} ${req.url}`);
+      socket.destroy();
+    });
+  }
+
   upstreamSocket.on('error', (err) => {
     console.error(`    WebSocket error: ${err.message} - ${req.method} ${req.url}`);
-    socket.destroy();
+    if (upstreamConnectErrors.includes(err.code)) {
+      upstreams.reportFailure(upstreamSocketPath);
+      writeSocketError(socket, 503, upstreamUnavailableMessage, getUnavailableError(err, upstreamSocketPath));
+    } else {
+      socket.destroy();
+    }
   });
 
   socket.on('error', (err) => {
@@ -378,31 +2799,511 @@ server.on('upgrade', (req, socket, head) => {
     upstreamSocket.destroy();
   });
 
+  // pipe() ends the other side when one side ends its write direction, which propagates half-closes both ways
+  socket.on('end', () => {
+    console.debug(`    Client closed its write side - ${req.method} ${req.url}`);
+  });
+
+  upstreamSocket.on('end', () => {
+    console.debug(`    Upstream closed its write side - ${req.method} ${req.url}`);
+  });
+
   socket.on('close', () => {
+    const duration = ((Date.now() - startTime) / 1000).toFixed(1);
+    const sent = Math.max(upstreamSocket.bytesWritten - requestLength, 0);
+    const received = upstreamSocket.bytesRead;
+    console.log(
+      `    Stream closed after ${duration}s, ${sent} bytes sent, ${received} bytes received - ${req.method} ${req.url}`
+    );
     console.debug(`    Client WebSocket disconnected - ${req.method} ${req.url}`);
     upstreamSocket.destroy();
   });
 
-  upstreamSocket.on('close', () => {
+  upstreamSocket.on('close', (hadError) => {
     console.debug(`    Upstream WebSocket disconnected - ${req.method} ${req.url}`);
+    // Let the client receive the rest of the data unless the connection failed
+    if (hadError) {
+      socket.destroy();
+    } else {
+      socket.end();
+    }
+  });
+}
+
+// Replaces the bare responses of Node.js to malformed requests with errors that Docker and podman clients can parse
+function handleClientError(err, socket) {
+  if (err.code === 'ECONNRESET' || !socket.writable) {
     socket.destroy();
+    return;
+  }
+  const statusCode = err.code === 'HPE_HEADER_OVERFLOW' ? 431 : err.code === 'ERR_HTTP_REQUEST_TIMEOUT' ? 408 : 400;
+  console.log(`${statusCode} - invalid request: ${err.message}`);
+  writeSocketError(socket, statusCode, 'Invalid request', err);
+}
+
+// Every downstream listener gets its own HTTP server sharing the same handlers
+// The requests on the sockets of other distros are marked with the distro, whose paths they are translated for
+function createServer(serverTlsOptions = null, clientDistro = null) {
+  const onRequest = clientDistro
+    ? (req, res) => handleRequest(Object.assign(req, { clientDistro }), res)
+    : handleRequest;
+  const onUpgrade = clientDistro
+    ? (req, socket, head) => handleUpgrade(Object.assign(req, { clientDistro }), socket, head)
+    : handleUpgrade;
+  // The buffer size applies to the client side of upgraded connections, which keep the socket of the server
+  const serverOptions = { highWaterMark: streamBufferSize };
+  const server = serverTlsOptions
+    ? https.createServer({ ...serverTlsOptions, ...serverOptions }, onRequest)
+    : http.createServer(serverOptions, onRequest);
+  // Answered with 100 Continue once the upstream accepts the request, instead of right away
+  server.on('checkContinue', onRequest);
+  server.on('upgrade', onUpgrade);
+  server.on('clientError', handleClientError);
+  if (h2c && !serverTlsOptions) {
+    acceptH2c(server, onRequest);
+  }
+  return server;
+}
+
+const userSockets = perUserSockets ? new UserSockets(createServer) : null;
+
+// The servers of the downstream sockets and TCP listeners: the listening server, the HTTP server handling its
+// connections (the same one unless it was handed over) and what a restarted process needs to know about it
+const listeners = [];
+let handedOver = false;
+
+// SIGHUP starts the executable again, e.g. after an upgrade, without closing the sockets: the new process takes over
+// the listeners, and this one exits once its connections are finished, so attach sessions and followed logs go on.
+function restart() {
+  const unsupported = [
+    systemdSocketFd && 'the systemd socket, restart the units instead',
+    // systemd would take the unit for stopped once this process exits, and leave the new one outside of it
+    (process.env.INVOCATION_ID || process.env.NOTIFY_SOCKET) && 'a systemd unit, restart the unit instead',
+    userSockets && 'per-user sockets',
+    tunnels.length && 'SSH and vsock upstreams',
+    pipeBridge && 'the named pipe',
+    mockUpstream && 'the mock upstream',
+    dropUid !== null && '--user, as the new process would not be root',
+  ].filter(Boolean);
+  if (unsupported.length) {
+    console.error(`Unable to restart without downtime with ${unsupported.join(', ')}`);
+    return;
+  }
+  if (handedOver || !listeners.length) {
+    return;
+  }
+  console.log('Restarting, handing the listeners over to a new process');
+  handOver(listeners, (pid) => {
+    handedOver = true;
+    console.log(`Handed the listeners over to PID ${pid}, exiting once the open connections are finished`);
+    let open = listeners.length;
+    for (const listener of listeners) {
+      closeListener(listener, () => {
+        open--;
+        if (open === 0) {
+          console.log('All connections are finished, exiting');
+          process.exit(0);
+        }
+      });
+    }
   });
-});
+}
+
+// Closing the server of a Unix socket removes the socket file, which the new process still listens on, so a second
+// link to it takes its place right away
+function closeListener({ server, httpServer, info }, callback) {
+  const link = info.socketPath && `${info.socketPath}.handoff`;
+  if (link) {
+    fs.rmSync(link, { force: true });
+    fs.linkSync(info.socketPath, link);
+  }
+  server.close(callback);
+  if (link) {
+    fs.renameSync(link, info.socketPath);
+  }
+  httpServer.closeIdleConnections();
+}
 
 function cleanup() {
+  // The sockets, the PID file and the shared root belong to the new process now
+  if (handedOver) {
+    process.exit();
+  }
+  if (distroSupervisors) {
+    distroSupervisors.forEach((supervisor) => supervisor.stop());
+    process.exit();
+  }
+  logTranslationSummary();
   console.log('Cleaning up and closing Unix socket.');
-  if (!systemdSocketFd && fs.existsSync(downstreamSocketPath)) {
-    fs.unlinkSync(downstreamSocketPath);
-    console.log('Closed Unix socket.');
+  if (userSockets) {
+    userSockets.stop();
+  }
+  tunnels.forEach((tunnel) => tunnel.stop());
+  if (pipeBridge) {
+    pipeBridge.stop();
+  }
+  if (eventMonitor) {
+    eventMonitor.stop();
+  }
+  if (mockUpstream) {
+    mockUpstream.stop();
+  }
+  removeDownstreamSockets();
+  releasePidFile(pidFile);
+  if (cleanupOnExit && mountDistroRoot) {
+    try {
+      unmountSharedMountpoint(sharedRoot);
+    } catch (err) {
+      console.error(`Unable to unmount the shared mountpoint: ${err.message}`);
+    }
   }
   process.exit();
 }
 
+// After switching to another user, the sockets may be in directories it cannot write to. They are replaced on the next
+// start then.
+function removeDownstreamSockets() {
+  for (const socket of downstreamSockets) {
+    if (fs.existsSync(socket.path)) {
+      try {
+        fs.unlinkSync(socket.path);
+      } catch (err) {
+        console.error(`Unable to remove Unix socket ${socket.path}: ${err.message}`);
+        continue;
+      }
+      console.log(`Closed Unix socket ${socket.path}.`);
+    }
+  }
+}
+
 process.on('SIGINT', cleanup);
 process.on('SIGTERM', cleanup);
+process.on('SIGHUP', restart);
+
+// Prints the result of every check and resolves to whether all of them passed
+async function checkEnvironment() {
+  const checks = [
+    { name: 'wslpath', run: () => execFileSync('wslpath', ['-am', '/'], { stdio: 'pipe' }).toString().trim() },
+    { name: '/mnt/wsl', run: checkWslMounted },
+    ...upstreamSocketPaths.map((address, i) => ({
+      name: `Upstream ${address}`,
+      run: async () => {
+        await pingWithRetries(upstreamAddresses[i], isTunnelAddress(address) ? 10 : 0);
+        return 'answered the ping';
+      },
+    })),
+  ];
+  tunnels.forEach((tunnel) => tunnel.start());
+  const passed = await runChecks(checks);
+  tunnels.forEach((tunnel) => tunnel.stop());
+  return passed;
+}
+
+// Every step of the translation of a bind source in create requests: the matching path rule, the Windows path, the
+// mount policy decision and the path sent to the machine, or what happens to the mount if it cannot be translated.
+// Sources of other distros are not on this distro's wslpath, so they have no Windows path.
+function describeTranslation(hostPath, clientDistro = null) {
+  const result = {
+    path: hostPath,
+    rule: null,
+    windowsPath: null,
+    windowsPathError: null,
+    policy: mountPolicy ? 'allowed' : 'none',
+    translated: null,
+    readOnly: false,
+    error: null,
+    failureMode: null,
+    action: null,
+  };
+  const mapped = applyPathRules(pathRules, hostPath);
+  if (mapped) {
+    result.rule = { path: mapped.path, final: !!mapped.final };
+  }
+  const rulePath = mapped ? mapped.path : hostPath;
+  if (!clientDistro && !(mapped && mapped.final) && rulePath.startsWith('/') && !rulePath.startsWith('/mnt/wsl/')) {
+    try {
+      result.windowsPath = wslPathToWindowsPath(rulePath);
+    } catch (err) {
+      result.windowsPathError = err.message;
+    }
+  }
+  try {
+    result.translated = translateHostPath(hostPath, clientDistro);
+    result.readOnly = isReadOnlyTranslation(result.translated);
+  } catch (err) {
+    const mode = getFailureMode(hostPath, err);
+    if (err instanceof MountDeniedError) {
+      result.policy = 'denied';
+    }
+    result.error = err.message;
+    result.failureMode = mode;
+    result.action = mode === 'strict' ? 'the request is rejected' : translationFailureActions[mode];
+  }
+  return result;
+}
+
+// Shows every step of the translation of create requests for the given bind sources. Returns whether all of them
+// could be translated.
+function translatePaths(hostPaths) {
+  prefetchWindowsPaths(hostPaths);
+  let translatedAll = true;
+  for (const hostPath of hostPaths) {
+    console.info(hostPath);
+    const result = describeTranslation(hostPath);
+    if (result.rule) {
+      console.info(`  Path rule: ${result.rule.path}${result.rule.final ? ' (final)' : ''}`);
+    }
+    if (result.windowsPath || result.windowsPathError) {
+      console.info(`  Windows path: ${result.windowsPath || `unknown (${result.windowsPathError})`}`);
+    }
+    if (result.error) {
+      if (result.policy === 'denied') {
+        console.info('  Mount policy: denied');
+      }
+      console.info(`  Error: ${result.error}`);
+      console.info(`  Mount: ${result.action}`);
+      translatedAll = false;
+    } else {
+      console.info(`  Mount policy: ${result.policy}`);
+      console.info(`  Translated: ${result.translated}${result.readOnly ? ' (read-only)' : ''}`);
+    }
+  }
+  return translatedAll;
+}
+
+// Runs a request body through the same policies, translation and hooks as the proxy. Bodies of other requests than
+// container creates are written unchanged.
+async function filterRequestBody({ method, url: apiPath }) {
+  const req = { method, url: apiPath, headers: {}, socket: null };
+  const policyViolation = getRequestPolicyViolation(req, false);
+  if (policyViolation) {
+    console.error(`Request blocked by policy: ${policyViolation}`);
+    return false;
+  }
+  const warnings = [];
+  try {
+    const filters = isContainerCreate(req) ? await createBodyFilters(req, warnings) : [];
+    await pipelineAsync(process.stdin, ...filters, process.stdout);
+  } catch (err) {
+    console.error(`Error processing request body: ${err.message}`);
+    return false;
+  }
+  warnings.forEach((warning) => console.error(`Warning: ${warning}`));
+  return true;
+}
+
+// Tunnels take a moment to open their local socket
+async function pingWithRetries(address, retries) {
+  for (let attempt = 0; ; attempt++) {
+    try {
+      return await pingUpstream(address, 5000);
+    } catch (err) {
+      if (attempt >= retries) {
+        throw err;
+      }
+    }
+    await new Promise((resolve) => setTimeout(resolve, 500));
+  }
+}
+
+// Two instances would fight over the downstream sockets and the shared root. Without write access to the default PID
+// file, e.g. when not running as root, the service starts without it.
+function lockPidFile() {
+  try {
+    acquirePidFile(pidFile, isHandoff() ? process.ppid : null);
+  } catch (err) {
+    if (err instanceof AlreadyRunningError || options.pidFile) {
+      console.error(`Unable to start: ${err.message} (${pidFile})`);
+      process.exit(1);
+    }
+    console.debug(`Unable to write the PID file ${pidFile}: ${err.message}`);
+  }
+}
+
+function onServiceReady() {
+  if (registerClientsOnStart) {
+    try {
+      registerClients(clientSocketUri);
+    } catch (err) {
+      console.error(`Unable to register the service with the clients: ${err.message}`);
+    }
+  }
+  if (dropUid !== null) {
+    dropPrivileges();
+  }
+  notifyReady();
+}
+
+// No capabilities are kept, Node.js cannot set them. The supplementary groups of root are dropped first, as only root
+// can change them.
+function dropPrivileges() {
+  try {
+    process.setgroups([dropGid]);
+    process.setgid(dropGid);
+    process.setuid(dropUid);
+  } catch (err) {
+    console.error(`Unable to switch to user ${dropUid} and group ${dropGid}: ${err.message}`);
+    process.exit(1);
+  }
+  console.log(`Switched to user ${getUserName(dropUid)} (UID ${dropUid}) and group ${dropGid}`);
+}
+
+// Provisions the service into other distros, e.g. from a single scheduled task on Windows, and keeps it running there.
+// The service in each distro gets the same options and mounts its root and serves its socket there.
+let distroSupervisors = null;
+function bootstrapDistros() {
+  let names = options.bootstrapDistro;
+  let executable = options.bootstrapExecutable;
+  try {
+    if (names.includes('all')) {
+      names = listDistros().filter((name) => name.toLowerCase() !== distroName.toLowerCase());
+    }
+    executable = executable || installBootstrapExecutable();
+  } catch (err) {
+    console.error(`Unable to bootstrap the distros: ${err.message}`);
+    process.exit(1);
+  }
+  const args = getServiceArgs(process.argv.slice(2));
+  distroSupervisors = names.map((name) => new DistroSupervisor(name, executable, args, pidFile));
+  distroSupervisors.forEach((supervisor) => supervisor.start());
+}
+
+async function start() {
+  // Listening for them right away, before the predecessor sends them
+  const handedOverListeners = isHandoff() ? receiveListeners() : null;
+  lockPidFile();
+  if (mockUpstream) {
+    mockUpstream.start();
+  }
+  // After a restart, the shared root is mounted already
+  if (mountDistroRoot && !isHandoff()) {
+    console.log(`Mounting shared mountpoint: ${sharedRoot}`);
+    try {
+      mountSharedMountpoint(sharedRoot);
+    } catch (err) {
+      console.error(`Unable to mount the shared mountpoint: ${err.message}`);
+      process.exit(1);
+    }
+  }
+  if (rootless && !isSharedMountpointMounted()) {
+    console.error(
+      `The shared root ${sharedRoot} is not mounted, bind mounts fail until it is, e.g. with ` +
+        '"sudo podman-wsl-service mount"'
+    );
+  }
+  if (mountDistroRoot) {
+    checkServedDistroRoots();
+    // Without root, the checks could not mount anything again
+    if (mountCheckInterval > 0 && dropUid === null) {
+      setInterval(checkSharedMountpoint, mountCheckInterval * 1000).unref();
+      setInterval(checkServedDistroRoots, mountCheckInterval * 1000).unref();
+    }
+  }
+  if (translationSummaryInterval > 0) {
+    setInterval(logTranslationSummary, translationSummaryInterval * 1000).unref();
+  }
+  if (statusInterval > 0) {
+    setInterval(logStatus, statusInterval * 1000).unref();
+  }
+  tunnels.forEach((tunnel) => tunnel.start());
+  if (waitForUpstream) {
+    try {
+      await upstreams.waitForLive(waitForUpstreamTimeout);
+    } catch (err) {
+      console.error(`Upstream is not available: ${err.message}`);
+      tunnels.forEach((tunnel) => tunnel.stop());
+      process.exit(1);
+    }
+  }
+  apiVersions.get(upstreams.active).then((range) => {
+    if (range) {
+      console.debug(`Upstream API versions: ${range.min || 'unknown'} to ${range.max}`);
+    }
+  });
 
-// Listen on a Unix socket
-server.listen(systemdSocketFd || downstreamSocketPath, () => {
-  console.log('Proxy server is listening on Unix socket');
+  // A detached or restarted service reports back once all listeners are up
+  const received = handedOverListeners ? await handedOverListeners : null;
+  let pendingListeners = received ? 0 : (systemdSocketFd ? 1 : 0) + downstreamSockets.length + tcpListeners.length;
+  const onListening = () => {
+    pendingListeners--;
+    if (pendingListeners === 0) {
+      onServiceReady();
+    }
+  };
+  const addListener = (server, info) => {
+    listeners.push({ server, httpServer: server, info });
+    return server;
+  };
+  if (received) {
+    // The listeners of the predecessor are kept as they are, changes to them take a full restart
+    for (const { info, handle } of received) {
+      const httpServer = createServer(info.tls ? tlsOptions : null, info.distro);
+      handle.on('connection', (socket) => httpServer.emit('connection', socket));
+      listeners.push({ server: handle, httpServer, info });
+      console.log(`Proxy server took over ${info.name}`);
+    }
+  } else {
+    if (systemdSocketFd) {
+      createServer().listen(systemdSocketFd, () => {
+        console.log('Proxy server is listening on the systemd socket');
+        onListening();
+      });
+    }
+    for (const socket of downstreamSockets) {
+      // Listen on a Unix socket
+      const info = { name: socket.path, socketPath: socket.path, distro: socket.distro };
+      listenOnSocket(addListener(createServer(null, socket.distro), info), socket, (err) => {
+        if (err) {
+          console.error(`Unable to listen on Unix socket ${socket.path}: ${err.message}`);
+          process.exit(1);
+        }
+        console.log(`Proxy server is listening on Unix socket ${socket.path}`);
+        onListening();
+      });
+    }
+    for (const listener of tcpListeners) {
+      const server = addListener(createServer(tlsOptions), { name: listener.address, tls: !!tlsOptions });
+      listenOnTcp(server, listener, tlsOptions, (err) => {
+        if (err) {
+          console.error(`Unable to listen on ${listener.host}:${listener.port}: ${err.message}`);
+          process.exit(1);
+        }
+        console.log(`Proxy server is listening on ${listener.address}${tlsOptions ? ' (TLS)' : ''}`);
+        onListening();
+      });
+    }
+  }
+  if (userSockets) {
+    userSockets.start();
+  }
+  if (pipeBridge) {
+    pipeBridge.start();
+  }
+  if (pendingListeners === 0) {
+    onServiceReady();
+  }
+  upstreams.start();
+  if (eventMonitor) {
+    eventMonitor.start();
+  }
   resetShutdownTimer();
-});
+}
+
+if (command === 'check') {
+  checkEnvironment().then((passed) => process.exit(passed ? 0 : 1));
+} else if (command === 'doctor') {
+  runChecks(getDoctorChecks(upstreamSocketPaths)).then((passed) => process.exit(passed ? 0 : 1));
+} else if (command === 'translate') {
+  process.exit(translatePaths(translateArguments) ? 0 : 1);
+} else if (command === 'selftest') {
+  const socketPath = downstreamSockets.length ? downstreamSockets[0].path : downstreamSocketDefault;
+  runSelfTest(socketPath, selfTestImage).then((passed) => process.exit(passed ? 0 : 1));
+} else if (command === 'filter') {
+  filterRequestBody(filterRequest).then((filtered) => process.exit(filtered ? 0 : 1));
+} else if (detachService && !isDetached()) {
+  detach(options.logFile);
+} else if (options.bootstrapDistro.length) {
+  bootstrapDistros();
+} else {
+  start();
+}
@@ -0,0 +1,76 @@
+// Patterns are "[METHOD ]/path", matched against the request path without the API version prefix. "*" matches
+// within a single path segment and "**" matches across segments. Deny wins over allow.
+function compilePattern(pattern) {
+  const match = pattern.match(/^(?:([A-Z]+)\s+)?(\/\S*)$/);
+  if (!match) {
+    throw new Error(`invalid API policy pattern: ${pattern}`);
+  }
+  const source = match[2]
+    .split(/(\*\*|\*)/)
+    .map((part) => {
+      if (part === '**') {
+        return '.*';
+      }
+      if (part === '*') {
+        return '[^/]*';
+      }
+      return part.replace(/[.+?^${}()|[\]\\]/g, '\\$&');
+    })
+    .join('');
+  return { pattern, method: match[1] || null, regex: new RegExp(`^${source}/?$`) };
+}
+
+function compileApiPolicy(policy) {
+  if (policy === undefined) {
+    return null;
+  }
+  if (policy === null || typeof policy !== 'object' || Array.isArray(policy)) {
+    throw new Error('"apiPolicy" must be an object');
+  }
+  const defaultAction = policy.default || 'allow';
+  if (defaultAction !== 'allow' && defaultAction !== 'deny') {
+    throw new Error('"apiPolicy.default" must be "allow" or "deny"');
+  }
+
+  const compiled = { defaultAction };
+  for (const action of ['allow', 'deny']) {
+    const patterns = policy[action] || [];
+    if (!Array.isArray(patterns) || patterns.some((p) => typeof p !== 'string')) {
+      throw new Error(`"apiPolicy.${action}" must be an array of strings`);
+    }
+    compiled[action] = patterns.map(compilePattern);
+  }
+  return compiled;
+}
+
+function findPattern(patterns, method, apiPath) {
+  return patterns.find((p) => (!p.method || p.method === method) && p.regex.test(apiPath));
+}
+
+// Returns a description of why the request is not allowed, or null if it is allowed
+function getApiPolicyViolation(policy, method, apiPath) {
+  if (!policy) {
+    return null;
+  }
+  const denied = findPattern(policy.deny, method, apiPath);
+  if (denied) {
+    return `denied by pattern '${denied.pattern}'`;
+  }
+  if (findPattern(policy.allow, method, apiPath)) {
+    return null;
+  }
+  return policy.defaultAction === 'deny' ? 'not in the allowed API list' : null;
+}
+
+// Read-only mode only forwards introspection requests. Upgraded connections (attach, exec) are always interactive.
+function getReadOnlyViolation(method, upgrade) {
+  if (method !== 'GET' && method !== 'HEAD') {
+    return `${method} requests are not allowed in read-only mode`;
+  }
+  if (upgrade) {
+    return 'interactive sessions are not allowed in read-only mode';
+  }
+  return null;
+}
+
+module.exports = { compileApiPolicy, getApiPolicyViolation, getReadOnlyViolation };
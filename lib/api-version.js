@@ -0,0 +1,73 @@
+const { requestUpstreamJson } = require('./upstream');
+
+// Docker API paths start with the API version, e.g. /v1.41/containers/json. Libpod paths carry the podman version
+// instead (/v5.0.0/libpod/...), which the upstream accepts regardless of its own version.
+const dockerVersionPattern = /^\/v(\d+(?:\.\d+)?)(\/(?!libpod\/).*)$/;
+
+function compareVersions(a, b) {
+  // A version without a minor one, e.g. /v1/, is x.0
+  const [aMajor, aMinor = 0] = a.split('.').map(Number);
+  const [bMajor, bMinor = 0] = b.split('.').map(Number);
+  return aMajor - bMajor || aMinor - bMinor;
+}
+
+// Returns the Docker API version a request asks for, or null for unversioned and libpod paths
+function getRequestedVersion(reqUrl) {
+  const match = reqUrl.match(dockerVersionPattern);
+  return match ? match[1] : null;
+}
+
+function parseApiVersion(value) {
+  if (!/^\d+\.\d+$/.test(value)) {
+    throw new Error(`invalid API version: ${value}, expected e.g. 1.40`);
+  }
+  return value;
+}
+
+// Keeps the range of Docker API versions supported by each upstream socket, as reported by /version. Newer clients
+// ask for versions the upstream does not know yet and get a confusing error, so their requests are sent with the
+// newest version the upstream supports instead, which is what clients negotiating the version would do anyway.
+class ApiVersions {
+  constructor() {
+    this.ranges = new Map();
+  }
+
+  // Returns null while the upstream cannot be asked, so requests are forwarded as they are
+  async get(address) {
+    if (!this.ranges.has(address)) {
+      const probe = requestUpstreamJson(address, 'GET', '/version')
+        .then((version) => {
+          if (!version || !version.ApiVersion) {
+            throw new Error('the response has no API version');
+          }
+          return { min: version.MinAPIVersion || null, max: version.ApiVersion };
+        })
+        .catch((err) => {
+          console.debug(`Unable to get the API versions of ${address}: ${err.message}`);
+          this.ranges.delete(address);
+          return null;
+        });
+      this.ranges.set(address, probe);
+    }
+    return this.ranges.get(address);
+  }
+
+  // Called when the upstream changed, e.g. because the machine was restarted with a different podman version
+  clear() {
+    this.ranges.clear();
+  }
+
+  async clampUrl(address, reqUrl) {
+    const match = reqUrl.match(dockerVersionPattern);
+    if (!match) {
+      return reqUrl;
+    }
+    const range = await this.get(address);
+    if (!range || compareVersions(match[1], range.max) <= 0) {
+      return reqUrl;
+    }
+    return `/v${range.max}${match[2]}`;
+  }
+}
+
+module.exports = { ApiVersions, compareVersions, getRequestedVersion, parseApiVersion };
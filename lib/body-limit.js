@@ -0,0 +1,34 @@
+const { Transform } = require('stream');
+const { ProxyError } = require('./errors');
+
+function tooLarge(maxBytes) {
+  return new ProxyError(413, `the request body is larger than the limit of ${maxBytes} bytes (--max-body-size)`);
+}
+
+// Fails the stream once more than the given number of bytes went through. Placed after the decoders, so compressed
+// bodies are limited by their decompressed size.
+class BodySizeLimit extends Transform {
+  constructor(maxBytes) {
+    super();
+    this.maxBytes = maxBytes;
+    this.bytes = 0;
+  }
+
+  _transform(chunk, encoding, callback) {
+    this.bytes += chunk.length;
+    if (this.bytes > this.maxBytes) {
+      callback(tooLarge(this.maxBytes));
+      return;
+    }
+    callback(null, chunk);
+  }
+}
+
+// Bodies announcing their size can be rejected before they are read
+function checkContentLength(headers, maxBytes) {
+  if (parseInt(headers['content-length'] || '0') > maxBytes) {
+    throw tooLarge(maxBytes);
+  }
+}
+
+module.exports = { BodySizeLimit, checkContentLength };
@@ -0,0 +1,91 @@
+const fs = require('fs');
+const path = require('path');
+const readline = require('readline');
+const { execFileSync, spawn } = require('child_process');
+const { distroSocketsDir } = require('./distros');
+
+// The packaged executable is copied to the tmpfs WSL shares between all distros, so every distro can run it
+const bootstrapExecutablePath = path.join(distroSocketsDir, 'bin', 'podman-wsl-service');
+
+// Options of the bootstrapping process that the service in the distro must not get
+const bootstrapOptions = { '--bootstrap-distro': true, '--bootstrap-executable': true, '--detach': false };
+
+function getServiceArgs(argv) {
+  const args = [];
+  for (let i = 0; i < argv.length; i++) {
+    const name = argv[i].split('=')[0];
+    if (name in bootstrapOptions) {
+      if (bootstrapOptions[name] && !argv[i].includes('=')) {
+        i++;
+      }
+      continue;
+    }
+    args.push(argv[i]);
+  }
+  return args;
+}
+
+// Copied next to the target and renamed, as a running executable cannot be overwritten
+function installBootstrapExecutable() {
+  if (!process.pkg) {
+    throw new Error('only the packaged executable can be copied into other distros, use --bootstrap-executable');
+  }
+  fs.mkdirSync(path.dirname(bootstrapExecutablePath), { recursive: true });
+  const tmpPath = `${bootstrapExecutablePath}.${process.pid}`;
+  fs.copyFileSync(process.execPath, tmpPath);
+  fs.chmodSync(tmpPath, 0o755);
+  fs.renameSync(tmpPath, bootstrapExecutablePath);
+  return bootstrapExecutablePath;
+}
+
+// Runs the service in another distro through wsl.exe and starts it again when it exits. Its output is logged with
+// the distro name in front.
+class DistroSupervisor {
+  constructor(distroName, executable, args, pidFile) {
+    this.distroName = distroName;
+    this.executable = executable;
+    this.args = args;
+    this.pidFile = pidFile;
+    this.process = null;
+    this.restartTimer = null;
+    this.stopped = false;
+  }
+
+  start() {
+    console.log(`Starting the service in distro ${this.distroName}`);
+    const args = ['-d', this.distroName, '-u', 'root', '-e', this.executable, ...this.args];
+    this.process = spawn('wsl.exe', args, { stdio: ['ignore', 'pipe', 'pipe'] });
+    for (const stream of [this.process.stdout, this.process.stderr]) {
+      readline.createInterface({ input: stream }).on('line', (line) => console.info(`[${this.distroName}] ${line}`));
+    }
+    this.process.on('error', (err) => console.error(`Unable to run wsl.exe for ${this.distroName}: ${err.message}`));
+    this.process.on('close', (code) => {
+      this.process = null;
+      if (this.stopped) {
+        return;
+      }
+      console.error(`The service in distro ${this.distroName} exited with code ${code}, starting it again`);
+      this.restartTimer = setTimeout(() => this.start(), 5000);
+    });
+  }
+
+  // Killing wsl.exe does not end the process in the distro, so it is stopped through its PID file
+  stop() {
+    this.stopped = true;
+    clearTimeout(this.restartTimer);
+    try {
+      execFileSync(
+        'wsl.exe',
+        ['-d', this.distroName, '-u', 'root', '-e', 'sh', '-c', 'kill "$(cat "$1")"', 'sh', this.pidFile],
+        { stdio: 'pipe', timeout: 10000 }
+      );
+    } catch (err) {
+      console.error(`Unable to stop the service in distro ${this.distroName}: ${err.message}`);
+    }
+    if (this.process) {
+      this.process.kill();
+    }
+  }
+}
+
+module.exports = { getServiceArgs, installBootstrapExecutable, DistroSupervisor };
@@ -0,0 +1,44 @@
+const fs = require('fs');
+const path = require('path');
+const { execFileSync } = require('child_process');
+const { version } = require('../package.json');
+
+const buildInfoPath = path.join(__dirname, 'build-info.json');
+
+// build-info.json is written by `npm run build-info` before packaging. Running from a checkout, it does not exist.
+function getBuildInfo() {
+  let buildInfo = { commit: 'unknown', buildDate: 'unknown' };
+  try {
+    buildInfo = require('./build-info.json');
+  } catch (err) {
+    // Not packaged
+  }
+  return { version, ...buildInfo, nodeVersion: process.version };
+}
+
+function formatBuildInfo(buildInfo) {
+  return [
+    `podman-wsl-service ${buildInfo.version}`,
+    `Commit: ${buildInfo.commit}`,
+    `Built: ${buildInfo.buildDate}`,
+    `Node.js: ${buildInfo.nodeVersion}`,
+  ].join('\n');
+}
+
+function writeBuildInfo() {
+  let commit = 'unknown';
+  try {
+    commit = execFileSync('git', ['rev-parse', '--short', 'HEAD'], { cwd: __dirname, stdio: 'pipe' }).toString().trim();
+  } catch (err) {
+    // Not built from a git checkout
+  }
+  const buildInfo = { commit, buildDate: new Date().toISOString() };
+  fs.writeFileSync(buildInfoPath, `${JSON.stringify(buildInfo, null, 2)}\n`);
+  console.log(`Wrote ${buildInfoPath}: ${buildInfo.commit}, ${buildInfo.buildDate}`);
+}
+
+if (require.main === module) {
+  writeBuildInfo();
+}
+
+module.exports = { getBuildInfo, formatBuildInfo };
@@ -0,0 +1,64 @@
+const fs = require('fs');
+const path = require('path');
+
+const profileScriptPath = '/etc/profile.d/podman-wsl-service.sh';
+const containersConfPath = '/etc/containers/containers.conf.d/podman-wsl-service.conf';
+const serviceDestinationName = 'podman-wsl-service';
+
+// Per-user sockets are found through the runtime directory of the user, which only the shell knows
+const perUserSocketUri = 'unix://${XDG_RUNTIME_DIR}/podman/podman.sock';
+
+function getSocketUri(socketPath, perUserSockets) {
+  return perUserSockets ? perUserSocketUri : `unix://${socketPath}`;
+}
+
+// The exports for the shell of a user, e.g. for eval "$(podman-wsl-service env)"
+function getClientExports(socketUri) {
+  return [`export DOCKER_HOST="${socketUri}"`, `export CONTAINER_HOST="${socketUri}"`].join('\n') + '\n';
+}
+
+// Podman picks up the active service destination from any drop-in of containers.conf
+function getContainersConf(socketUri) {
+  return [
+    '[engine]',
+    `active_service = "${serviceDestinationName}"`,
+    '',
+    `[engine.service_destinations.${serviceDestinationName}]`,
+    `uri = "${socketUri}"`,
+    '',
+  ].join('\n');
+}
+
+function writeIfChanged(filePath, content) {
+  let current = null;
+  try {
+    current = fs.readFileSync(filePath, 'utf8');
+  } catch (err) {
+    // Not registered yet
+  }
+  if (current !== content) {
+    fs.mkdirSync(path.dirname(filePath), { recursive: true });
+    fs.writeFileSync(filePath, content);
+    console.log(`Wrote ${filePath}`);
+  }
+}
+
+// Points the docker and podman clients of all users to the service. The containers.conf destination cannot expand the
+// runtime directory, so it is left out with per-user sockets.
+function registerClients(socketUri) {
+  writeIfChanged(profileScriptPath, `# Written by podman-wsl-service\n${getClientExports(socketUri)}`);
+  if (!socketUri.includes('$')) {
+    writeIfChanged(containersConfPath, `# Written by podman-wsl-service\n${getContainersConf(socketUri)}`);
+  }
+}
+
+function unregisterClients() {
+  for (const filePath of [profileScriptPath, containersConfPath]) {
+    if (fs.existsSync(filePath)) {
+      fs.unlinkSync(filePath);
+      console.log(`Removed ${filePath}`);
+    }
+  }
+}
+
+module.exports = { getSocketUri, getClientExports, registerClients, unregisterClients };
@@ -0,0 +1,114 @@
+const completionShells = ['bash', 'zsh', 'fish'];
+
+const helpOption = { long: '--help', short: '-h', description: 'Display help for the command' };
+
+// The options of the program and of all commands. All of them are offered everywhere, as commander accepts the program
+// options after the command as well.
+function getCompletionOptions(program) {
+  const options = [...program.options, ...program.commands.flatMap((command) => command.options), helpOption];
+  const seen = new Set();
+  return options
+    .filter((option) => !seen.has(option.long) && seen.add(option.long))
+    .map((option) => ({
+      names: [option.short, option.long].filter(Boolean),
+      long: option.long,
+      short: option.short,
+      description: option.description,
+      takesValue: !!(option.required || option.optional),
+    }));
+}
+
+function getCompletionCommands(program) {
+  return program.commands.map((command) => ({ name: command.name(), description: command.description() }));
+}
+
+function generateBashCompletion(name, options, commands) {
+  const functionName = `_${name.replace(/-/g, '_')}`;
+  const valueOptions = options.filter((option) => option.takesValue).flatMap((option) => option.names);
+  return `${functionName}() {
+  local cur="\${COMP_WORDS[COMP_CWORD]}"
+  local prev="\${COMP_WORDS[COMP_CWORD-1]}"
+  case "$prev" in
+    ${valueOptions.join('|')})
+      COMPREPLY=($(compgen -f -- "$cur"))
+      return
+      ;;
+  esac
+  if [[ "$cur" == -* ]]; then
+    COMPREPLY=($(compgen -W "${options.flatMap((option) => option.names).join(' ')}" -- "$cur"))
+  else
+    COMPREPLY=($(compgen -W "${commands.map((command) => command.name).join(' ')}" -- "$cur"))
+  fi
+}
+complete -o default -F ${functionName} ${name}
+`;
+}
+
+function quoteZsh(text) {
+  return `'${text.replace(/'/g, "'\\''")}'`;
+}
+
+function generateZshCompletion(name, options, commands) {
+  const functionName = `_${name.replace(/-/g, '_')}`;
+  const escapeDescription = (description) => description.replace(/[\\[\]]/g, '\\$&');
+  const specs = options.flatMap((option) => {
+    const exclusion = option.names.length > 1 ? `(${option.names.join(' ')})` : '';
+    const value = option.takesValue ? ':value:_files' : '';
+    return option.names.map((optionName) =>
+      quoteZsh(`${exclusion}${optionName}[${escapeDescription(option.description)}]${value}`)
+    );
+  });
+  const commandSpecs = commands.map((command) =>
+    quoteZsh(`${command.name}:${command.description.replace(/:/g, '\\:')}`)
+  );
+  return `#compdef ${name}
+
+${functionName}() {
+  local -a commands
+  commands=(
+    ${commandSpecs.join('\n    ')}
+  )
+  local state
+  _arguments -s \\
+    ${specs.join(' \\\n    ')} \\
+    '1: :->command' \\
+    '*: :_files'
+  case $state in
+    command) _describe -t commands command commands ;;
+  esac
+}
+
+${functionName} "$@"
+`;
+}
+
+function quoteFish(text) {
+  return `'${text.replace(/[\\']/g, '\\$&')}'`;
+}
+
+function generateFishCompletion(name, options, commands) {
+  const lines = [`complete -c ${name} -f`];
+  for (const command of commands) {
+    lines.push(
+      `complete -c ${name} -n __fish_use_subcommand -a ${command.name} -d ${quoteFish(command.description)}`
+    );
+  }
+  for (const option of options) {
+    const flags = [
+      ...(option.short ? [`-s ${option.short.slice(1)}`] : []),
+      `-l ${option.long.slice(2)}`,
+      ...(option.takesValue ? ['-r -F'] : []),
+    ];
+    lines.push(`complete -c ${name} ${flags.join(' ')} -d ${quoteFish(option.description)}`);
+  }
+  return `${lines.join('\n')}\n`;
+}
+
+const generators = { bash: generateBashCompletion, zsh: generateZshCompletion, fish: generateFishCompletion };
+
+// Generates the completion script for the given shell from the options and commands defined on the program
+function generateCompletion(shell, program) {
+  return generators[shell](program.name(), getCompletionOptions(program), getCompletionCommands(program));
+}
+
+module.exports = { completionShells, generateCompletion };
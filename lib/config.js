@@ -0,0 +1,20 @@
+const fs = require('fs');
+
+const defaultConfigPath = '/etc/podman-wsl-service/config.json';
+
+// A missing config file is only an error if the path was explicitly requested
+function loadConfig(configPath, required) {
+  if (!fs.existsSync(configPath)) {
+    if (required) {
+      throw new Error(`Config file not found: ${configPath}`);
+    }
+    return {};
+  }
+  const config = JSON.parse(fs.readFileSync(configPath, 'utf8'));
+  if (config === null || typeof config !== 'object' || Array.isArray(config)) {
+    throw new Error(`Config file must contain a JSON object: ${configPath}`);
+  }
+  return config;
+}
+
+module.exports = { defaultConfigPath, loadConfig };
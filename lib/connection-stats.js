@@ -0,0 +1,88 @@
+function getBytesIn(entry) {
+  return (entry.socket.bytesRead || 0) - entry.bytesRead;
+}
+
+function getBytesOut(entry) {
+  return (entry.socket.bytesWritten || 0) - entry.bytesWritten;
+}
+
+// The requests and streams in progress, to tell which client keeps the machine busy. The byte counts are those of the
+// client connection since the request headers were received, so earlier requests on a kept-alive connection do not
+// count. The totals since the start include the finished ones.
+class ConnectionStats {
+  constructor(getClientCredentials) {
+    this.getClientCredentials = getClientCredentials;
+    this.entries = new Set();
+    this.totals = { requests: 0, bytesIn: 0, bytesOut: 0 };
+  }
+
+  // Forgotten once the response or the stream is closed
+  add(req, closable) {
+    const socket = req.socket;
+    const entry = {
+      req,
+      socket,
+      started: Date.now(),
+      bytesRead: socket.bytesRead || 0,
+      bytesWritten: socket.bytesWritten || 0,
+      hijacked: false,
+    };
+    this.entries.add(entry);
+    this.totals.requests++;
+    closable.on('close', () => {
+      this.entries.delete(entry);
+      this.totals.bytesIn += getBytesIn(entry);
+      this.totals.bytesOut += getBytesOut(entry);
+    });
+    return entry;
+  }
+
+  getTotals() {
+    const open = [...this.entries];
+    return {
+      requests: this.totals.requests,
+      bytesIn: open.reduce((sum, entry) => sum + getBytesIn(entry), this.totals.bytesIn),
+      bytesOut: open.reduce((sum, entry) => sum + getBytesOut(entry), this.totals.bytesOut),
+    };
+  }
+
+  async getSnapshot() {
+    const now = Date.now();
+    return Promise.all(
+      [...this.entries].map(async (entry) => {
+        const cred = await this.getClientCredentials(entry.req);
+        return {
+          method: entry.req.method,
+          url: entry.req.url,
+          uptime: (now - entry.started) / 1000,
+          bytesIn: getBytesIn(entry),
+          bytesOut: getBytesOut(entry),
+          hijacked: entry.hijacked,
+          distro: entry.req.clientDistro || null,
+          client: cred ? { pid: cred.pid, uid: cred.uid, user: cred.user, program: cred.program } : null,
+        };
+      })
+    );
+  }
+
+  // Logged on SIGQUIT, longest running first
+  async log() {
+    const snapshot = await this.getSnapshot();
+    console.info(`Active connections: ${snapshot.length}`);
+    for (const entry of snapshot.sort((a, b) => b.uptime - a.uptime)) {
+      const kind = entry.hijacked ? 'hijacked stream' : 'request';
+      let client = 'unknown client';
+      if (entry.client) {
+        client = `${entry.client.user} (UID ${entry.client.uid}), PID ${entry.client.pid}: ${entry.client.program}`;
+      } else if (entry.distro) {
+        client = `client in distro ${entry.distro}`;
+      }
+      console.info(
+        `    ${entry.method} ${entry.url} - ${kind} for ${entry.uptime.toFixed(1)}s, ` +
+          `${entry.bytesIn} bytes in, ${entry.bytesOut} bytes out, ${client}`
+      );
+    }
+  }
+}
+
+module.exports = { ConnectionStats };
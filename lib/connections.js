@@ -0,0 +1,121 @@
+const fs = require('fs');
+const os = require('os');
+const path = require('path');
+
+const connectionPrefix = 'connection:';
+
+function isConnectionAddress(address) {
+  return address.startsWith(connectionPrefix);
+}
+
+// Podman 4.8 and later keep the connections in podman-connections.json, older versions in containers.conf
+function getConnectionFiles(home) {
+  const configHome = process.env.XDG_CONFIG_HOME || path.join(home, '.config');
+  return [
+    path.join(configHome, 'containers', 'podman-connections.json'),
+    process.env.CONTAINERS_CONF || path.join(configHome, 'containers', 'containers.conf'),
+    '/etc/containers/containers.conf',
+    '/usr/share/containers/containers.conf',
+  ];
+}
+
+function parseTomlString(value) {
+  const match = /^\s*("(?:[^"\\]|\\.)*"|'[^']*')/.exec(value);
+  if (!match) {
+    return null;
+  }
+  return match[1].startsWith('"') ? JSON.parse(match[1]) : match[1].slice(1, -1);
+}
+
+function parseTomlKey(key) {
+  key = key.trim();
+  return key.startsWith('"') || key.startsWith("'") ? parseTomlString(key) : key;
+}
+
+// Only the connections are read from containers.conf: the tables [engine.service_destinations.<name>] and the inline
+// tables in [engine.service_destinations], with their "uri" and "identity"
+function parseServiceDestinations(text) {
+  const destinations = {};
+  let table = null;
+  for (const rawLine of text.split(/\r?\n/)) {
+    const line = rawLine.trim();
+    if (!line || line.startsWith('#')) {
+      continue;
+    }
+    const header = /^\[\s*engine\.service_destinations(?:\.(.+?))?\s*\]$/.exec(line);
+    if (header) {
+      table = header[1] ? parseTomlKey(header[1]) : '';
+      if (table) {
+        destinations[table] = destinations[table] || {};
+      }
+      continue;
+    }
+    if (line.startsWith('[')) {
+      table = null;
+      continue;
+    }
+    if (table === null) {
+      continue;
+    }
+    const separator = line.indexOf('=');
+    if (separator < 0) {
+      continue;
+    }
+    const key = parseTomlKey(line.slice(0, separator));
+    const value = line.slice(separator + 1).trim();
+    if (table) {
+      destinations[table][key] = parseTomlString(value);
+    } else if (value.startsWith('{')) {
+      destinations[key] = {};
+      for (const member of value.slice(1, value.lastIndexOf('}')).split(',')) {
+        const memberSeparator = member.indexOf('=');
+        if (memberSeparator >= 0) {
+          destinations[key][parseTomlKey(member.slice(0, memberSeparator))] = parseTomlString(
+            member.slice(memberSeparator + 1)
+          );
+        }
+      }
+    }
+  }
+  return destinations;
+}
+
+function readConnections(file) {
+  let text;
+  try {
+    text = fs.readFileSync(file, 'utf8');
+  } catch (err) {
+    return {};
+  }
+  if (file.endsWith('.json')) {
+    const connections = JSON.parse(text).Connection?.Connections || {};
+    return Object.fromEntries(
+      Object.entries(connections).map(([name, c]) => [name, { uri: c.URI, identity: c.Identity }])
+    );
+  }
+  return parseServiceDestinations(text);
+}
+
+// Resolves "connection:<name>" to the URI and SSH identity of the podman-remote connection, as listed by
+// "podman system connection list" for the user running the service
+function resolveConnection(address, home = os.homedir()) {
+  const name = address.slice(connectionPrefix.length);
+  for (const file of getConnectionFiles(home)) {
+    let connections;
+    try {
+      connections = readConnections(file);
+    } catch (err) {
+      throw new Error(`unable to read the podman connections in ${file}: ${err.message}`);
+    }
+    const connection = connections[name];
+    if (connection) {
+      if (typeof connection.uri !== 'string' || !/^(unix|tcp|ssh):\/\//.test(connection.uri)) {
+        throw new Error(`podman connection ${name} in ${file} has no unix://, tcp:// or ssh:// URI`);
+      }
+      return { uri: connection.uri, identity: connection.identity || null };
+    }
+  }
+  throw new Error(`unknown podman connection ${name}`);
+}
+
+module.exports = { isConnectionAddress, resolveConnection };
@@ -0,0 +1,110 @@
+const path = require('path');
+const { spawn } = require('child_process');
+const { Transform } = require('stream');
+const { ProxyError } = require('./errors');
+
+const defaultHookTimeout = 10;
+
+// Entries are either executables or objects with a "command" (an executable or an array with its arguments) and an
+// optional "timeout" in seconds
+function compileCreateHooks(hooks) {
+  if (!Array.isArray(hooks)) {
+    throw new Error('"createHooks" must be an array');
+  }
+  return hooks.map((hook, i) => {
+    const spec = typeof hook === 'string' ? { command: hook } : hook || {};
+    const command = typeof spec.command === 'string' ? [spec.command] : spec.command;
+    if (!Array.isArray(command) || !command.length || command.some((arg) => typeof arg !== 'string')) {
+      throw new Error(`createHooks[${i}]: "command" must be a string or an array of strings`);
+    }
+    const timeout = spec.timeout === undefined ? defaultHookTimeout : spec.timeout;
+    if (typeof timeout !== 'number' || !(timeout > 0)) {
+      throw new Error(`createHooks[${i}]: "timeout" must be a positive number of seconds`);
+    }
+    return { name: path.basename(command[0]), command, timeout };
+  });
+}
+
+// The hook gets the body on stdin. It exits with 0 to let the request through, with the modified body on stdout or
+// nothing to keep it, and with any other code to reject it, with the reason on stderr.
+function runHook(hook, body, env) {
+  return new Promise((resolve, reject) => {
+    const child = spawn(hook.command[0], hook.command.slice(1), {
+      env: { ...process.env, ...env },
+      stdio: ['pipe', 'pipe', 'pipe'],
+    });
+    const stdout = [];
+    const stderr = [];
+    child.stdout.on('data', (chunk) => stdout.push(chunk));
+    child.stderr.on('data', (chunk) => stderr.push(chunk));
+    const timer = setTimeout(() => {
+      child.kill('SIGKILL');
+      reject(new ProxyError(500, `create hook ${hook.name} did not finish within ${hook.timeout} seconds`));
+    }, hook.timeout * 1000);
+    child.on('error', (err) => {
+      clearTimeout(timer);
+      reject(new ProxyError(500, `unable to run create hook ${hook.name}: ${err.message}`));
+    });
+    child.on('close', (code, signal) => {
+      clearTimeout(timer);
+      if (code !== 0) {
+        const status = signal ? `killed by ${signal}` : `exit code ${code}`;
+        const reason = Buffer.concat(stderr).toString().trim() || status;
+        reject(new ProxyError(403, `rejected by create hook ${hook.name}: ${reason}`));
+        return;
+      }
+      const output = Buffer.concat(stdout).toString().trim();
+      if (!output) {
+        resolve(body);
+        return;
+      }
+      try {
+        const parsed = JSON.parse(output);
+        if (parsed === null || typeof parsed !== 'object' || Array.isArray(parsed)) {
+          throw new Error('expected a JSON object');
+        }
+      } catch (err) {
+        reject(new ProxyError(500, `create hook ${hook.name} returned an invalid body: ${err.message}`));
+        return;
+      }
+      resolve(output);
+    });
+    // Hooks that do not read the body close stdin early
+    child.stdin.on('error', () => {});
+    child.stdin.end(body);
+  });
+}
+
+// Buffers the (already translated) create body and passes it through the hooks in order. Unlike the bind mount
+// rewriting, hooks need the whole body, so it is held in memory while they run.
+class CreateHookRunner extends Transform {
+  constructor(hooks, env) {
+    super();
+    this.hooks = hooks;
+    this.env = env;
+    this.chunks = [];
+  }
+
+  _transform(chunk, encoding, callback) {
+    this.chunks.push(chunk);
+    callback();
+  }
+
+  _flush(callback) {
+    this.run().then((body) => callback(null, body), callback);
+  }
+
+  async run() {
+    let body = Buffer.concat(this.chunks).toString();
+    for (const hook of this.hooks) {
+      const result = await runHook(hook, body, this.env);
+      if (result !== body) {
+        console.log(`Create hook ${hook.name} modified the request`);
+      }
+      body = result;
+    }
+    return body;
+  }
+}
+
+module.exports = { compileCreateHooks, CreateHookRunner };
@@ -0,0 +1,105 @@
+const fs = require('fs');
+const path = require('path');
+const { spawn } = require('child_process');
+
+const defaultLogFilePath = '/var/log/podman-wsl-service.log';
+
+// Set for the background process, which runs the service like it would in the foreground
+const detachedEnvName = 'PODMAN_WSL_SERVICE_DETACHED';
+
+// Set to the number of listeners a restarted process is handed by its predecessor
+const handoffEnvName = 'PODMAN_WSL_SERVICE_HANDOFF';
+
+// The command line that runs this executable again, from a packaged executable or from a checkout
+function getExecutable() {
+  return process.pkg ? [process.execPath] : [process.execPath, path.resolve(process.argv[1])];
+}
+
+function isDetached() {
+  return process.env[detachedEnvName] === '1';
+}
+
+// Starts the service again in a new session, with its output going to the log file, and exits once it is listening.
+// Fails if the service exits before, e.g. because the shared root cannot be mounted.
+function detach(logFilePath) {
+  const [executable, ...executableArgs] = getExecutable();
+  const logFd = fs.openSync(logFilePath, 'a');
+  const child = spawn(executable, [...executableArgs, ...process.argv.slice(2)], {
+    detached: true,
+    stdio: ['ignore', logFd, logFd, 'ipc'],
+    env: { ...process.env, [detachedEnvName]: '1' },
+  });
+  child.on('message', (message) => {
+    if (message === 'ready') {
+      console.info(`Started in the background with PID ${child.pid}, logging to ${logFilePath}`);
+      process.exit(0);
+    }
+  });
+  child.on('exit', (code) => {
+    console.error(`The service exited with code ${code} before it was listening, see ${logFilePath}`);
+    process.exit(1);
+  });
+}
+
+function isHandoff() {
+  return process.env[handoffEnvName] !== undefined;
+}
+
+// Starts the executable again, e.g. after it was upgraded, and hands it the listening servers along with what the new
+// process needs to know about them. The servers keep accepting connections until the new process is listening, then
+// onHandedOver is called. If the new process fails to start, this one carries on.
+function handOver(listeners, onHandedOver) {
+  const [executable, ...executableArgs] = getExecutable();
+  const child = spawn(executable, [...executableArgs, ...process.argv.slice(2)], {
+    stdio: ['ignore', 'inherit', 'inherit', 'ipc'],
+    env: { ...process.env, [handoffEnvName]: String(listeners.length) },
+  });
+  const onExit = (code) => console.error(`The new process exited with code ${code} before taking over, carrying on`);
+  child.on('exit', onExit);
+  child.on('message', (message) => {
+    if (message === 'ready') {
+      child.off('exit', onExit);
+      onHandedOver(child.pid);
+    }
+  });
+  listeners.forEach(({ server, info }) => child.send({ listener: info }, server));
+}
+
+// Resolves to the servers handed over by the predecessor as { info, handle }, the handle being a listening net.Server
+function receiveListeners() {
+  const count = parseInt(process.env[handoffEnvName]);
+  const listeners = [];
+  return new Promise((resolve) => {
+    const onMessage = (message, handle) => {
+      if (message && message.listener && handle) {
+        listeners.push({ info: message.listener, handle });
+      }
+      if (listeners.length === count) {
+        process.off('message', onMessage);
+        resolve(listeners);
+      }
+    };
+    process.on('message', onMessage);
+    if (count === 0) {
+      resolve(listeners);
+    }
+  });
+}
+
+// Tells the waiting parent process that the service is listening. Does nothing when not detached or restarted.
+function notifyReady() {
+  if ((isDetached() || isHandoff()) && process.send) {
+    process.send('ready', () => process.disconnect());
+  }
+}
+
+module.exports = {
+  defaultLogFilePath,
+  getExecutable,
+  isDetached,
+  detach,
+  isHandoff,
+  handOver,
+  receiveListeners,
+  notifyReady,
+};
@@ -0,0 +1,88 @@
+const fs = require('fs');
+const path = require('path');
+
+const podmanSocketsDir = '/mnt/wsl/podman-sockets';
+const defaultMachineName = 'podman-machine-default';
+const socketKinds = { root: 'podman-root.sock', user: 'podman-user.sock' };
+
+function isSocket(socketPath) {
+  try {
+    return fs.statSync(socketPath).isSocket();
+  } catch (err) {
+    return false;
+  }
+}
+
+// The socket a machine exports for its rootful ("root") or rootless ("user") API
+function getMachineSocketPath(machine, kind, baseDir = podmanSocketsDir) {
+  if (!/^[\w.-]+$/.test(machine)) {
+    throw new Error(`invalid machine name: ${machine}`);
+  }
+  if (!socketKinds[kind]) {
+    throw new Error(`invalid machine socket kind: ${kind}, expected ${Object.keys(socketKinds).join(' or ')}`);
+  }
+  return path.join(baseDir, machine, socketKinds[kind]);
+}
+
+// Podman machines export their API sockets to /mnt/wsl/podman-sockets/<machine>/. The default machine comes first,
+// and for each machine the socket of the preferred kind ("root" or "user") comes before the other one.
+function discoverUpstreamSockets(preference, baseDir = podmanSocketsDir) {
+  let machines;
+  try {
+    machines = fs
+      .readdirSync(baseDir, { withFileTypes: true })
+      .filter((entry) => entry.isDirectory())
+      .map((entry) => entry.name);
+  } catch (err) {
+    return [];
+  }
+  machines.sort((a, b) => (a === defaultMachineName ? -1 : b === defaultMachineName ? 1 : a.localeCompare(b)));
+
+  const kinds = preference === 'user' ? ['user', 'root'] : ['root', 'user'];
+  const sockets = [];
+  for (const machine of machines) {
+    for (const kind of kinds) {
+      const socketPath = path.join(baseDir, machine, socketKinds[kind]);
+      if (isSocket(socketPath)) {
+        sockets.push({ machine, kind, path: socketPath });
+      }
+    }
+  }
+  return sockets;
+}
+
+// Returns the socket of the given kind exported next to the given one, whether it exists or not. Other paths are
+// returned as they are.
+function withSocketKind(socketPath, kind) {
+  if (!Object.values(socketKinds).includes(path.basename(socketPath))) {
+    return socketPath;
+  }
+  return path.join(path.dirname(socketPath), socketKinds[kind]);
+}
+
+// Returns the socket of the given kind exported next to the given one, or null if there is none
+function getSiblingSocket(socketPath, kind) {
+  if (!Object.values(socketKinds).includes(path.basename(socketPath))) {
+    return null;
+  }
+  const sibling = path.join(path.dirname(socketPath), socketKinds[kind]);
+  return isSocket(sibling) ? sibling : null;
+}
+
+// Returns the name of the machine exporting the given socket, or null for sockets outside the podman sockets directory
+function getMachineName(socketPath, baseDir = podmanSocketsDir) {
+  const dir = path.dirname(socketPath);
+  return path.dirname(dir) === baseDir ? path.basename(dir) : null;
+}
+
+module.exports = {
+  podmanSocketsDir,
+  defaultMachineName,
+  socketKinds,
+  isSocket,
+  getMachineSocketPath,
+  withSocketKind,
+  discoverUpstreamSockets,
+  getSiblingSocket,
+  getMachineName,
+};
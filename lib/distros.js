@@ -0,0 +1,51 @@
+const path = require('path');
+const { execFileSync } = require('child_process');
+
+// Sockets served for other distros live on the tmpfs WSL shares between all of them
+const distroSocketsDir = '/mnt/wsl/podman-wsl-service';
+
+// The distros of the machines and of Docker Desktop run the engines, not their clients
+const engineDistroPattern = /^(podman-machine|podman-|docker-desktop)/i;
+
+function getDistroSocketPath(distroName) {
+  return path.join(distroSocketsDir, distroName, 'podman.sock');
+}
+
+// wsl.exe writes its output in UTF-16
+function listDistros() {
+  const output = execFileSync('wsl.exe', ['--list', '--quiet'], { timeout: 10000 });
+  return output
+    .toString('utf16le')
+    .replace(/\0/g, '')
+    .split(/\r?\n/)
+    .map((line) => line.trim())
+    .filter((name) => name && !engineDistroPattern.test(name));
+}
+
+// A distro's root can only be bound from inside the distro, so the mount is run there through wsl.exe. Like the own
+// shared root, it shows up in the machine through the shared /mnt/wsl.
+function bindDistroRoot(distroName, mountPoint, propagation) {
+  const script =
+    `mountpoint -q "$1" && exit 0; mount --make-shared / && mkdir -p "$1" && mount --rbind / "$1" && ` +
+    `mount --make-${propagation} "$1"`;
+  execFileSync('wsl.exe', ['-d', distroName, '-u', 'root', '-e', 'sh', '-c', script, 'sh', mountPoint], {
+    stdio: 'pipe',
+    timeout: 30000,
+  });
+}
+
+// Paths sent by the clients of another distro are made \\wsl.localhost paths of that distro, which the translation
+// maps to its shared root. Windows drives are expected at the default automount root, and paths below /mnt/wsl are the
+// same in all distros.
+function toDistroPath(distroName, hostPath) {
+  if (typeof hostPath !== 'string' || !hostPath.startsWith('/') || hostPath.startsWith('/mnt/wsl/')) {
+    return hostPath;
+  }
+  const drive = /^\/mnt\/([a-z])(?:\/(.*))?$/i.exec(hostPath);
+  if (drive) {
+    return `${drive[1].toUpperCase()}:\\${(drive[2] || '').replace(/\//g, '\\')}`;
+  }
+  return `\\\\wsl.localhost\\${distroName}${hostPath.replace(/\//g, '\\')}`;
+}
+
+module.exports = { distroSocketsDir, getDistroSocketPath, listDistros, bindDistroRoot, toDistroPath };
@@ -0,0 +1,186 @@
+const fs = require('fs');
+const path = require('path');
+const { readMountInfo } = require('./mountinfo');
+const {
+  podmanSocketsDir,
+  socketKinds,
+  discoverUpstreamSockets,
+  getSiblingSocket,
+  getMachineName,
+} = require('./discovery');
+
+// Runs the checks in order and prints one line for each, with the fix for the failed ones. Resolves to whether all of
+// them passed.
+async function runChecks(checks) {
+  let passed = true;
+  for (const check of checks) {
+    try {
+      console.info(`OK   ${check.name}: ${await check.run()}`);
+    } catch (err) {
+      console.info(`FAIL ${check.name}: ${err.message}`);
+      if (err.fix || check.fix) {
+        console.info(`     Fix: ${err.fix || check.fix}`);
+      }
+      passed = false;
+    }
+  }
+  return passed;
+}
+
+// WSL 2 kernels are called e.g. 5.15.153.1-microsoft-standard-WSL2, WSL 1 reports a version string with "Microsoft"
+function getWslVersion() {
+  const version = fs.readFileSync('/proc/version', 'utf8');
+  if (/microsoft-standard|WSL2/i.test(version)) {
+    return 2;
+  }
+  return /microsoft/i.test(version) ? 1 : null;
+}
+
+function isWslMounted() {
+  return readMountInfo().some((mount) => mount.mountPoint === '/mnt/wsl');
+}
+
+function checkWslMounted() {
+  if (!isWslMounted()) {
+    throw new Error('not mounted, the podman machine cannot see the shared root');
+  }
+  return 'mounted';
+}
+
+// Tells the usual reasons for a missing upstream socket apart, with the commands that fix them. Returns null if the
+// socket exists, as its problems are then on the side of the machine.
+function diagnoseUpstreamSocket(socketPath) {
+  if (fs.existsSync(socketPath)) {
+    return null;
+  }
+  if (!isWslMounted()) {
+    return {
+      cause: '/mnt/wsl is not mounted, so the podman machine cannot export its sockets to the distro',
+      fix: 'restart WSL with "wsl --shutdown" on Windows',
+    };
+  }
+  const machine = getMachineName(socketPath);
+  if (!machine) {
+    return { cause: `${socketPath} does not exist`, fix: 'check the upstream socket options and the config file' };
+  }
+  const kind = path.basename(socketPath) === socketKinds.root ? 'root' : 'user';
+  if (getSiblingSocket(socketPath, kind === 'root' ? 'user' : 'root')) {
+    return kind === 'root'
+      ? {
+          cause: `machine ${machine} only exports its rootless socket, it was created without --rootful`,
+          fix:
+            `run "podman machine stop ${machine}", "podman machine set --rootful ${machine}" and ` +
+            `"podman machine start ${machine}" on Windows, or use --upstream-mode user`,
+        }
+      : {
+          cause: `machine ${machine} only exports its rootful socket`,
+          fix:
+            `run "podman machine set --rootful=false ${machine}" on Windows and restart the machine, or use ` +
+            '--upstream-mode root',
+        };
+  }
+  const others = new Set(discoverUpstreamSockets('root').map((socket) => socket.machine));
+  others.delete(machine);
+  return {
+    cause:
+      `machine ${machine} is not running or does not exist` +
+      (others.size ? `, sockets are exported by ${[...others].join(', ')}` : ''),
+    fix: `run "podman machine start ${machine}" on Windows, or use --auto-start-machine`,
+  };
+}
+
+function checkUpstreamSocket(socketPath) {
+  let stats;
+  try {
+    stats = fs.statSync(socketPath);
+  } catch (err) {
+    const diagnosis = diagnoseUpstreamSocket(socketPath);
+    throw Object.assign(new Error(`does not exist, ${diagnosis.cause}`), { fix: diagnosis.fix });
+  }
+  if (!stats.isSocket()) {
+    throw new Error('is not a socket');
+  }
+  try {
+    fs.accessSync(socketPath, fs.constants.R_OK | fs.constants.W_OK);
+  } catch (err) {
+    throw new Error(`is not accessible by UID ${process.getuid()}`);
+  }
+  return 'accessible';
+}
+
+// The environment problems behind most setups that do not work
+function getDoctorChecks(upstreamSocketPaths) {
+  const unixSocketPaths = upstreamSocketPaths.filter((address) => !/^[a-z]+:\/\//.test(address));
+  return [
+    {
+      name: 'WSL version',
+      run: () => {
+        const version = getWslVersion();
+        if (version !== 2) {
+          throw new Error(version ? 'WSL 1, which cannot run podman machines' : 'not running in WSL');
+        }
+        return 'WSL 2';
+      },
+      fix: 'convert the distro with "wsl --set-version <distro> 2" on Windows',
+    },
+    {
+      name: 'Interop',
+      run: () => {
+        const interopNames = ['WSLInterop', 'WSLInterop-late'];
+        if (!interopNames.some((name) => fs.existsSync(`/proc/sys/fs/binfmt_misc/${name}`))) {
+          throw new Error('Windows executables cannot be run, so wslpath and --auto-start-machine do not work');
+        }
+        return 'enabled';
+      },
+      fix: 'set "enabled = true" in the [interop] section of /etc/wsl.conf and restart the distro',
+    },
+    {
+      name: 'systemd',
+      run: () => {
+        if (!fs.existsSync('/run/systemd/system')) {
+          throw new Error('not running, the installed units are not started');
+        }
+        return 'running';
+      },
+      fix:
+        'set "systemd = true" in the [boot] section of /etc/wsl.conf and restart the distro, ' +
+        'or start the service from boot.command',
+    },
+    {
+      name: '/mnt/wsl',
+      run: checkWslMounted,
+      fix: 'restart WSL with "wsl --shutdown" on Windows',
+    },
+    {
+      name: 'Propagation of /',
+      run: () => {
+        const root = readMountInfo()
+          .filter((mount) => mount.mountPoint === '/')
+          .pop();
+        if (!root || !root.optionalFields.some((field) => field.startsWith('shared:'))) {
+          throw new Error('private, mounts made in the distro later on only reach the machine once it is made shared');
+        }
+        return 'shared';
+      },
+      fix: 'run "mount --make-shared /", which the service does at startup unless --no-make-root-shared is given',
+    },
+    {
+      name: 'Exported sockets',
+      run: () => {
+        const sockets = discoverUpstreamSockets('root');
+        if (!sockets.length) {
+          throw new Error(`no machine exports its sockets to ${podmanSocketsDir}`);
+        }
+        return sockets.map((socket) => `${socket.machine} (${socket.kind})`).join(', ');
+      },
+      fix: 'start the machine with "podman machine start" on Windows',
+    },
+    ...unixSocketPaths.map((socketPath) => ({
+      name: `Upstream ${socketPath}`,
+      run: () => checkUpstreamSocket(socketPath),
+      fix: 'run the service as root',
+    })),
+  ];
+}
+
+module.exports = { runChecks, checkWslMounted, diagnoseUpstreamSocket, getDoctorChecks };
@@ -0,0 +1,213 @@
+const fs = require('fs');
+const net = require('net');
+const path = require('path');
+const { execFileSync } = require('child_process');
+const { resolveUid, resolveGid } = require('./passwd');
+
+// Modes may be given as numbers or octal strings ("0660")
+function parseMode(mode) {
+  const parsed = typeof mode === 'number' ? mode : parseInt(String(mode), 8);
+  if (!Number.isInteger(parsed) || parsed < 0 || parsed > 0o7777) {
+    throw new Error(`Invalid socket mode: ${mode}`);
+  }
+  return parsed;
+}
+
+// POSIX ACL entries in the setfacl format, e.g. "user:vscode:rw"; connecting to a socket needs write access
+function parseAclEntry(entry) {
+  if (typeof entry !== 'string' || !/^(u|user|g|group):[^:\s]+:[rwx-]{1,3}$/.test(entry)) {
+    throw new Error(`Invalid socket ACL entry, expected user:<name>:rw or group:<name>:rw: ${entry}`);
+  }
+  return entry;
+}
+
+function parseAcl(acl) {
+  if (!Array.isArray(acl)) {
+    throw new Error(`Invalid socket ACL, expected an array of entries: ${acl}`);
+  }
+  return acl.map(parseAclEntry);
+}
+
+// Entries are either paths or objects with a "path" and optional "mode", "owner", "group" and "acl"
+function compileDownstreamSockets(sockets) {
+  if (!Array.isArray(sockets)) {
+    throw new Error('"downstreamSockets" must be an array');
+  }
+  return sockets.map((socket, i) => {
+    const spec = typeof socket === 'string' ? { path: socket } : socket;
+    if (!spec || typeof spec.path !== 'string') {
+      throw new Error(`downstreamSockets[${i}]: "path" must be a string`);
+    }
+    return {
+      path: spec.path,
+      mode: spec.mode === undefined ? null : parseMode(spec.mode),
+      uid: spec.owner === undefined ? null : resolveUid(String(spec.owner)),
+      gid: spec.group === undefined ? null : resolveGid(String(spec.group)),
+      acl: spec.acl === undefined ? null : parseAcl(spec.acl),
+    };
+  });
+}
+
+// The permissions given on the command line apply to the Unix sockets that do not set their own
+function applySocketPermissions(specs, { mode, owner, group, acl }) {
+  const defaults = {
+    mode: mode === undefined ? null : parseMode(mode),
+    uid: owner === undefined ? null : resolveUid(owner),
+    gid: group === undefined ? null : resolveGid(group),
+    acl: acl && acl.length ? parseAcl(acl) : null,
+  };
+  for (const spec of specs.filter((s) => !s.tcp)) {
+    for (const [key, value] of Object.entries(defaults)) {
+      if (spec[key] === null) {
+        spec[key] = value;
+      }
+    }
+  }
+}
+
+// Accepts tcp://host:port and unix:///path addresses
+function parseListenAddress(address) {
+  let parsed;
+  try {
+    parsed = new URL(address);
+  } catch (err) {
+    throw new Error(`Invalid listen address: ${address}`);
+  }
+  if (parsed.protocol === 'unix:') {
+    return compileDownstreamSockets([parsed.pathname])[0];
+  }
+  if (parsed.protocol !== 'tcp:' || !parsed.port) {
+    throw new Error(`Invalid listen address, expected tcp://host:port or unix:///path: ${address}`);
+  }
+  return { tcp: true, host: parsed.hostname.replace(/^\[(.*)]$/, '$1'), port: parseInt(parsed.port), address };
+}
+
+function isLoopbackHost(host) {
+  return host === 'localhost' || host === '::1' || /^127\./.test(host);
+}
+
+// Resolves to whether a process accepts connections on the socket. A socket file left behind by a crashed service
+// refuses them.
+function isSocketLive(socketPath) {
+  return new Promise((resolve) => {
+    const socket = net.connect(socketPath, () => {
+      socket.destroy();
+      resolve(true);
+    });
+    socket.on('error', () => resolve(false));
+  });
+}
+
+// A leftover socket file is only replaced when nothing listens on it anymore, so a second instance cannot take the
+// socket of a running one
+async function removeStaleSocket(socketPath) {
+  if (!fs.lstatSync(socketPath).isSocket()) {
+    throw new Error(`${socketPath} exists and is not a socket`);
+  }
+  if (await isSocketLive(socketPath)) {
+    throw new Error(`another process is listening on ${socketPath}, is the service running already?`);
+  }
+  console.log(`Removing the stale socket ${socketPath}`);
+  fs.rmSync(socketPath, { force: true });
+}
+
+// Other users must not be able to connect before the mode and owner are applied, so the socket is created with no
+// permissions for them. Node binds it right away, so the umask is only changed while listen() runs.
+function listenPrivately(server, socketPath) {
+  const umask = process.umask(0o177);
+  try {
+    server.listen(socketPath);
+  } finally {
+    process.umask(umask);
+  }
+  return umask;
+}
+
+// Calls back with an error if the socket cannot be listened on. Without a mode, the socket gets the permissions the
+// umask gives it.
+function listenOnSocket(server, spec, callback) {
+  fs.mkdirSync(path.dirname(spec.path), { recursive: true });
+  let retried = false;
+  let umask;
+  const onError = async (err) => {
+    if (err.code !== 'EADDRINUSE' || retried) {
+      server.off('error', onError);
+      callback(err);
+      return;
+    }
+    retried = true;
+    try {
+      await removeStaleSocket(spec.path);
+    } catch (staleErr) {
+      server.off('error', onError);
+      callback(staleErr);
+      return;
+    }
+    umask = listenPrivately(server, spec.path);
+  };
+  server.on('error', onError);
+  server.once('listening', () => {
+    server.off('error', onError);
+    try {
+      if (spec.uid !== null || spec.gid !== null) {
+        fs.chownSync(spec.path, spec.uid ?? -1, spec.gid ?? -1);
+      }
+      fs.chmodSync(spec.path, spec.mode !== null ? spec.mode : 0o777 & ~umask);
+      // Node has no API for ACLs; setfacl also updates the mask so that the entries take effect
+      if (spec.acl) {
+        execFileSync('setfacl', ['-m', spec.acl.join(','), spec.path], { stdio: 'pipe' });
+      }
+    } catch (err) {
+      console.error(`Unable to set the permissions of ${spec.path}: ${err.message}`);
+    }
+    callback(null);
+  });
+  umask = listenPrivately(server, spec.path);
+}
+
+// Like the Docker daemon, the cert dir provides defaults for cert.pem, key.pem and (if present) ca.pem. Client
+// certificates are verified whenever a CA is configured.
+function loadTlsOptions({ certDir, cert, key, ca }) {
+  const fromDir = (name) => (certDir ? path.join(certDir, name) : null);
+  const certFile = cert || fromDir('cert.pem');
+  const keyFile = key || fromDir('key.pem');
+  const caFile = ca || (certDir && fs.existsSync(fromDir('ca.pem')) ? fromDir('ca.pem') : null);
+  if (!certFile && !keyFile) {
+    return null;
+  }
+  if (!certFile || !keyFile) {
+    throw new Error('Both a TLS certificate and key are required');
+  }
+
+  const tlsOptions = { cert: fs.readFileSync(certFile), key: fs.readFileSync(keyFile) };
+  if (caFile) {
+    tlsOptions.ca = fs.readFileSync(caFile);
+    tlsOptions.requestCert = true;
+    tlsOptions.rejectUnauthorized = true;
+  }
+  return tlsOptions;
+}
+
+// Calls back with an error if the port is taken or the address cannot be listened on
+function listenOnTcp(server, spec, tlsOptions, callback) {
+  if (!isLoopbackHost(spec.host) && !(tlsOptions && tlsOptions.requestCert)) {
+    console.error(`WARNING: ${spec.address} exposes the Podman API to the network without authentication`);
+  }
+  const onError = (err) => callback(err);
+  server.once('error', onError);
+  server.once('listening', () => {
+    server.off('error', onError);
+    callback(null);
+  });
+  server.listen(spec.port, spec.host);
+}
+
+module.exports = {
+  parseMode,
+  compileDownstreamSockets,
+  applySocketPermissions,
+  parseListenAddress,
+  loadTlsOptions,
+  listenOnSocket,
+  listenOnTcp,
+};
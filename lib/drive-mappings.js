@@ -0,0 +1,80 @@
+const path = require('path');
+
+// Podman machines mount the Windows drives at /mnt/<drive>, like WSL does by default
+const defaultDriveMapping = (drive) => `/mnt/${drive.toLowerCase()}`;
+
+// Maps drive letters to where the machine sees the drives. Drives that are not listed use the default mount point.
+function compileDriveMappings(mappings) {
+  if (mappings === undefined) {
+    return {};
+  }
+  if (mappings === null || typeof mappings !== 'object' || Array.isArray(mappings)) {
+    throw new Error('"driveMappings" must be an object');
+  }
+  const compiled = {};
+  for (const [drive, mountPoint] of Object.entries(mappings)) {
+    const letter = drive.replace(/:$/, '');
+    if (!/^[A-Za-z]$/.test(letter)) {
+      throw new Error(`driveMappings: invalid drive "${drive}"`);
+    }
+    if (typeof mountPoint !== 'string' || !mountPoint.startsWith('/')) {
+      throw new Error(`driveMappings.${drive}: must be an absolute path`);
+    }
+    compiled[letter.toUpperCase()] = mountPoint;
+  }
+  return compiled;
+}
+
+// Rewrites a Windows drive path (C:\Users\me) to the path inside the machine (/mnt/c/Users/me). Other paths, e.g. UNC
+// paths, are returned as they are.
+function mapDrivePath(mappings, windowsPath) {
+  const match = windowsPath.match(/^([A-Za-z]):(?:\\(.*))?$/);
+  if (!match) {
+    return windowsPath;
+  }
+  const drive = match[1].toUpperCase();
+  const mountPoint = mappings[drive] || defaultDriveMapping(drive);
+  return path.posix.join(mountPoint, (match[2] || '').replace(/\\/g, '/'));
+}
+
+const sharePattern = /^(\\\\[^\\]+\\[^\\]+)(?:\\(.*))?$/;
+
+// Maps network shares (\\server\share) to where they are mounted in the machine, e.g. with CIFS
+function compileShareMappings(mappings) {
+  if (mappings === undefined) {
+    return {};
+  }
+  if (mappings === null || typeof mappings !== 'object' || Array.isArray(mappings)) {
+    throw new Error('"shareMappings" must be an object');
+  }
+  const compiled = {};
+  for (const [share, mountPoint] of Object.entries(mappings)) {
+    const match = share.replace(/\\+$/, '').match(sharePattern);
+    if (!match || match[2]) {
+      throw new Error(`shareMappings: invalid share "${share}", expected \\\\server\\share`);
+    }
+    if (typeof mountPoint !== 'string' || !mountPoint.startsWith('/')) {
+      throw new Error(`shareMappings: the mount point of ${share} must be an absolute path`);
+    }
+    compiled[match[1].toLowerCase()] = mountPoint;
+  }
+  return compiled;
+}
+
+// Returns the share of a UNC path, or null for other paths
+function getShare(windowsPath) {
+  const match = windowsPath.match(sharePattern);
+  return match ? match[1] : null;
+}
+
+// Rewrites a path on a network share to the path inside the machine, or returns null if the share is not mapped
+function mapSharePath(mappings, windowsPath) {
+  const match = windowsPath.match(sharePattern);
+  const mountPoint = match && mappings[match[1].toLowerCase()];
+  if (!mountPoint) {
+    return null;
+  }
+  return path.posix.join(mountPoint, (match[2] || '').replace(/\\/g, '/'));
+}
+
+module.exports = { compileDriveMappings, mapDrivePath, compileShareMappings, getShare, mapSharePath };
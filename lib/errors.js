@@ -0,0 +1,17 @@
+// Errors carrying the HTTP status code the proxy should answer with
+class ProxyError extends Error {
+  constructor(statusCode, message) {
+    super(message);
+    this.name = 'ProxyError';
+    this.statusCode = statusCode;
+  }
+}
+
+class MountDeniedError extends ProxyError {
+  constructor(message) {
+    super(403, message);
+    this.name = 'MountDeniedError';
+  }
+}
+
+module.exports = { ProxyError, MountDeniedError };
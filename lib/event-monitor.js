@@ -0,0 +1,117 @@
+const http = require('http');
+const readline = require('readline');
+const { parseUpstreamAddress } = require('./upstream');
+
+// The actions that change the state of a container; attach, exec and health check events are left out
+const lifecycleActions = ['create', 'start', 'restart', 'pause', 'unpause', 'stop', 'kill', 'die', 'oom', 'remove'];
+
+// Follows the container events of the upstream on its own connection and logs the lifecycle of the containers created
+// through the service, which goes on after their client has disconnected. The stream is opened again when it ends,
+// e.g. because the machine was restarted.
+class EventMonitor {
+  constructor(getAddress, tracker) {
+    this.getAddress = getAddress;
+    this.tracker = tracker;
+    this.counts = Object.fromEntries(lifecycleActions.map((action) => [action, 0]));
+    this.req = null;
+    this.timer = null;
+    this.stopped = false;
+  }
+
+  start() {
+    const filters = encodeURIComponent(JSON.stringify({ type: ['container'] }));
+    let options;
+    try {
+      options = parseUpstreamAddress(this.getAddress());
+    } catch (err) {
+      console.error(`Unable to monitor the container events: ${err.message}`);
+      return;
+    }
+    const req = http.request({ ...options, agent: false, path: `/events?filters=${filters}` }, (res) => {
+      if (res.statusCode !== 200) {
+        console.error(`Unable to monitor the container events: status ${res.statusCode}`);
+        res.resume();
+        return;
+      }
+      console.debug('Monitoring the container events of the upstream');
+      // The request is started again once it is closed
+      readline
+        .createInterface({ input: res })
+        .on('line', (line) => this.handleLine(line))
+        .on('error', (err) => console.debug(`The container event stream failed: ${err.message}`));
+    });
+    // Aborted requests are not worth logging
+    req.on('error', (err) => {
+      if (this.req === req) {
+        console.debug(`Unable to monitor the container events: ${err.message}`);
+      }
+    });
+    req.on('close', () => {
+      if (this.req === req) {
+        this.req = null;
+        this.restartLater();
+      }
+    });
+    req.end();
+    this.req = req;
+  }
+
+  restartLater() {
+    if (!this.stopped) {
+      this.timer = setTimeout(() => {
+        this.timer = null;
+        this.start();
+      }, 5000);
+    }
+  }
+
+  // Called when the active upstream changed, once started
+  restart() {
+    if (this.stopped || (!this.req && !this.timer)) {
+      return;
+    }
+    this.abort();
+    clearTimeout(this.timer);
+    this.timer = null;
+    this.start();
+  }
+
+  stop() {
+    this.stopped = true;
+    clearTimeout(this.timer);
+    this.abort();
+  }
+
+  abort() {
+    const req = this.req;
+    this.req = null;
+    if (req) {
+      req.destroy();
+    }
+  }
+
+  handleLine(line) {
+    let event;
+    try {
+      event = this.tracker.annotate(JSON.parse(line));
+    } catch (err) {
+      return;
+    }
+    const actor = event && event.Type === 'container' ? event.Actor : null;
+    const action = ((event && event.Action) || '').split(':')[0];
+    if (!actor || !this.tracker.containers.has(actor.ID) || !lifecycleActions.includes(action)) {
+      return;
+    }
+    this.counts[action]++;
+    const attributes = actor.Attributes || {};
+    const name = attributes.name ? `${attributes.name} (${actor.ID.slice(0, 12)})` : actor.ID.slice(0, 12);
+    const exitCode = action === 'die' && attributes.exitCode !== undefined ? `, exit code ${attributes.exitCode}` : '';
+    console.log(`Container ${name} of distro ${this.tracker.containers.get(actor.ID)}: ${action}${exitCode}`);
+  }
+
+  getStats() {
+    return { ...this.counts };
+  }
+}
+
+module.exports = { EventMonitor };
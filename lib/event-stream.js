@@ -0,0 +1,73 @@
+const { Transform } = require('stream');
+const { StringDecoder } = require('string_decoder');
+
+// The number of containers remembered, the oldest are forgotten beyond it
+const maxTrackedContainers = 10000;
+
+// Remembers the containers created through the service and the distro of their client, by the ID in the create
+// response or by the distro label the service adds, which removal events do not always carry
+class ContainerTracker {
+  constructor(distroNames) {
+    this.distroNames = distroNames;
+    this.containers = new Map();
+  }
+
+  add(id, distroName) {
+    this.containers.delete(id);
+    this.containers.set(id, distroName);
+    if (this.containers.size > maxTrackedContainers) {
+      this.containers.delete(this.containers.keys().next().value);
+    }
+  }
+
+  // Adds the "wsl.distro" attribute to the events of tracked containers
+  annotate(event) {
+    const actor = event && event.Type === 'container' ? event.Actor : null;
+    if (!actor || !actor.ID) {
+      return event;
+    }
+    const attributes = actor.Attributes || {};
+    if (this.distroNames.includes(attributes['wsl.distro'])) {
+      this.add(actor.ID, attributes['wsl.distro']);
+    }
+    if (this.containers.has(actor.ID)) {
+      actor.Attributes = { ...attributes, 'wsl.distro': this.containers.get(actor.ID) };
+    }
+    return event;
+  }
+}
+
+// Event streams are JSON documents separated by newlines. Every complete line is parsed and rewritten; anything that
+// is not JSON, such as the heartbeat newlines, is passed through as it is.
+class EventStreamRewriter extends Transform {
+  constructor(rewrite) {
+    super();
+    this.rewrite = rewrite;
+    this.decoder = new StringDecoder('utf8');
+    this.line = '';
+  }
+
+  _transform(chunk, encoding, callback) {
+    const lines = (this.line + this.decoder.write(chunk)).split('\n');
+    this.line = lines.pop();
+    callback(null, lines.map((line) => this.rewriteLine(line) + '\n').join(''));
+  }
+
+  _flush(callback) {
+    const line = this.line + this.decoder.end();
+    callback(null, line ? this.rewriteLine(line) : '');
+  }
+
+  rewriteLine(line) {
+    if (!line.trim()) {
+      return line;
+    }
+    try {
+      return JSON.stringify(this.rewrite(JSON.parse(line)));
+    } catch (err) {
+      return line;
+    }
+  }
+}
+
+module.exports = { ContainerTracker, EventStreamRewriter };
@@ -0,0 +1,53 @@
+const faultKinds = ['latency', 'drop', 'error', 'reset'];
+const errorStatusCodes = [500, 502, 503];
+
+// Faults for testing how clients cope with a flaky machine: a share of the requests is delayed, has its connection
+// dropped before the response, gets a random 5xx error or has its response cut off after the first chunk.
+function compileFaults({ rate, kinds, latency }) {
+  const percent = parseFloat(rate);
+  if (!(percent >= 0 && percent <= 100)) {
+    throw new Error(`invalid fault rate: ${rate}, expected a percentage`);
+  }
+  const kindList = kinds.split(',').map((kind) => kind.trim());
+  const unknown = kindList.find((kind) => !faultKinds.includes(kind));
+  if (unknown) {
+    throw new Error(`unknown fault kind: ${unknown}, expected ${faultKinds.join(', ')}`);
+  }
+  const latencyMs = parseInt(latency);
+  if (!(latencyMs >= 0)) {
+    throw new Error(`invalid fault latency: ${latency}`);
+  }
+  return percent > 0 ? { rate: percent / 100, kinds: kindList, latency: latencyMs } : null;
+}
+
+// Returns the fault to inject into a request, if any
+function pickFault(faults) {
+  if (!faults || Math.random() >= faults.rate) {
+    return null;
+  }
+  return faults.kinds[Math.floor(Math.random() * faults.kinds.length)];
+}
+
+function pickErrorStatusCode() {
+  return errorStatusCodes[Math.floor(Math.random() * errorStatusCodes.length)];
+}
+
+// HTTP/2 responses are ended through their stream
+function resetResponse(res) {
+  (res.stream || res).destroy();
+}
+
+// Cuts the response off right after its first chunk, like an upstream that goes away mid-stream. Responses written
+// at once are never completed.
+function resetAfterFirstChunk(res) {
+  const write = res.write;
+  res.write = function (...args) {
+    res.write = write;
+    const result = write.apply(res, args);
+    setImmediate(() => resetResponse(res));
+    return result;
+  };
+  res.end = () => resetResponse(res);
+}
+
+module.exports = { faultKinds, compileFaults, pickFault, pickErrorStatusCode, resetResponse, resetAfterFirstChunk };
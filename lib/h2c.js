@@ -0,0 +1,64 @@
+const http2 = require('http2');
+
+const preface = Buffer.from('PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n');
+
+// HTTP/2 pseudo-headers and headers that are not allowed in HTTP/2 responses
+const http2ResponseSkipHeaders = ['transfer-encoding'];
+
+function isHttp2Request(req) {
+  return req.httpVersionMajor === 2;
+}
+
+// Converts the headers of an HTTP/2 request to HTTP/1.1 headers for the upstream
+function getHttp1Headers(req) {
+  const headers = {};
+  for (const [name, value] of Object.entries(req.headers)) {
+    if (!name.startsWith(':')) {
+      headers[name] = value;
+    }
+  }
+  if (!headers.host && req.headers[':authority']) {
+    headers.host = req.headers[':authority'];
+  }
+  return headers;
+}
+
+// Serves cleartext HTTP/2 with prior knowledge (h2c) next to HTTP/1.1 on the given server. Node's HTTP/1.1 parser
+// rejects the HTTP/2 connection preface, so the first bytes of every connection are inspected before it is handed to
+// either of the servers. They may arrive in small chunks, so the data is buffered until it is either the whole preface
+// or no longer the start of it. HTTP/2 requests are handled by the same request listener.
+function acceptH2c(server, requestListener) {
+  const http2Server = http2.createServer(requestListener);
+  http2Server.on('checkContinue', requestListener);
+  const http1Listeners = server.listeners('connection');
+  server.removeAllListeners('connection');
+  server.on('connection', (socket) => {
+    let data = Buffer.alloc(0);
+    const onData = (chunk) => {
+      data = Buffer.concat([data, chunk]);
+      const length = Math.min(data.length, preface.length);
+      const isPreface = data.subarray(0, length).equals(preface.subarray(0, length));
+      if (isPreface && data.length < preface.length) {
+        return;
+      }
+      socket.off('data', onData);
+      socket.off('end', onEnd);
+      socket.pause();
+      socket.unshift(data);
+      if (isPreface) {
+        // The HTTP/2 session reads the buffered data itself
+        http2Server.emit('connection', socket);
+      } else {
+        http1Listeners.forEach((listener) => listener.call(server, socket));
+        socket.resume();
+      }
+    };
+    // A connection that ends within the preface is neither a complete HTTP/1.1 request nor an HTTP/2 session
+    const onEnd = () => socket.destroy();
+    socket.on('data', onData);
+    socket.once('end', onEnd);
+  });
+  return http2Server;
+}
+
+module.exports = { http2ResponseSkipHeaders, isHttp2Request, getHttp1Headers, acceptH2c };
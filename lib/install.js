@@ -0,0 +1,99 @@
+const fs = require('fs');
+const { execFileSync } = require('child_process');
+
+const unitDir = '/etc/systemd/system';
+const serviceUnitName = 'podman-wsl-service.service';
+const socketUnitName = 'podman-wsl-service.socket';
+const tmpfilesPath = '/etc/tmpfiles.d/podman-wsl-service.conf';
+
+// Added to the command line for socket activation unless it sets an idle time already, like in the unit installed by
+// install.sh
+const socketActivationArgs = ['--time', '30'];
+
+// Quotes an argument for ExecStart, where systemd expands specifiers (%) and environment variables ($) as well
+function quoteUnitArgument(arg) {
+  const escaped = arg.replace(/%/g, '%%').replace(/\$/g, '$$$$');
+  return /^[\w@%+=:,./-]+$/.test(escaped) ? escaped : `"${escaped.replace(/[\\"]/g, '\\$&')}"`;
+}
+
+function getServiceUnit(execStart, socketActivation) {
+  return [
+    '[Unit]',
+    'Description=Podman WSL Service',
+    ...(socketActivation ? [`Requires=${socketUnitName}`] : []),
+    'After=network.target',
+    '',
+    '[Service]',
+    `ExecStart=${execStart.map(quoteUnitArgument).join(' ')}`,
+    'Restart=on-failure',
+    'TimeoutStopSec=10',
+    'KillMode=process',
+    ...(socketActivation ? [`Sockets=${socketUnitName}`] : []),
+    'StandardOutput=journal',
+    'StandardError=journal',
+    ...(socketActivation ? [] : ['', '[Install]', 'WantedBy=multi-user.target']),
+    '',
+  ].join('\n');
+}
+
+function getSocketUnit(socketPath, { mode, owner, group, acl }) {
+  const unitPath = socketPath.replace(/%/g, '%%');
+  return [
+    '[Unit]',
+    'Description=Podman WSL Service',
+    `PartOf=${serviceUnitName}`,
+    '',
+    '[Socket]',
+    `ListenStream=${unitPath}`,
+    `SocketMode=${mode || '0660'}`,
+    ...(owner ? [`SocketUser=${owner}`] : []),
+    ...(group ? [`SocketGroup=${group}`] : []),
+    'DirectoryMode=0755',
+    ...(acl && acl.length ? [`ExecStartPost=setfacl -m ${acl.join(',')} ${quoteUnitArgument(socketPath)}`] : []),
+    'Accept=false',
+    '',
+    '[Install]',
+    'WantedBy=sockets.target',
+    '',
+  ].join('\n');
+}
+
+function writeFile(filePath, content) {
+  fs.writeFileSync(filePath, content);
+  console.log(`Wrote ${filePath}`);
+}
+
+// Installs and starts the units running the given command line. With socket activation, systemd listens on the
+// downstream socket; without it, the service runs all the time and creates its sockets itself, in the /run/podman
+// directory created by the tmpfiles.d entry.
+function installUnits(execStart, { socketActivation = true, socketPath, socketPermissions = {} } = {}) {
+  writeFile(`${unitDir}/${serviceUnitName}`, getServiceUnit(execStart, socketActivation));
+  if (socketActivation) {
+    writeFile(`${unitDir}/${socketUnitName}`, getSocketUnit(socketPath, socketPermissions));
+  } else if (fs.existsSync(`${unitDir}/${socketUnitName}`)) {
+    execFileSync('systemctl', ['disable', '--now', socketUnitName], { stdio: 'inherit' });
+    fs.unlinkSync(`${unitDir}/${socketUnitName}`);
+  }
+  writeFile(tmpfilesPath, 'd /run/podman 0755 root root -\n');
+  execFileSync('systemd-tmpfiles', ['--create', tmpfilesPath], { stdio: 'inherit' });
+  execFileSync('systemctl', ['daemon-reload'], { stdio: 'inherit' });
+  const unit = socketActivation ? socketUnitName : serviceUnitName;
+  execFileSync('systemctl', ['enable', '--now', unit], { stdio: 'inherit' });
+  console.log(`Enabled ${unit}`);
+}
+
+function uninstallUnits() {
+  const units = [socketUnitName, serviceUnitName].filter((unit) => fs.existsSync(`${unitDir}/${unit}`));
+  if (units.length) {
+    execFileSync('systemctl', ['disable', '--now', ...units], { stdio: 'inherit' });
+  }
+  for (const filePath of [...units.map((unit) => `${unitDir}/${unit}`), tmpfilesPath]) {
+    if (fs.existsSync(filePath)) {
+      fs.unlinkSync(filePath);
+      console.log(`Removed ${filePath}`);
+    }
+  }
+  execFileSync('systemctl', ['daemon-reload'], { stdio: 'inherit' });
+}
+
+module.exports = { socketActivationArgs, installUnits, uninstallUnits };
@@ -0,0 +1,267 @@
+const { Transform } = require('stream');
+const { StringDecoder } = require('string_decoder');
+const { ProxyError } = require('./errors');
+
+const whitespace = ' \t\n\r';
+
+// Rewrites a JSON object while streaming it. Only the top-level members with the given keys are buffered and parsed;
+// they are removed from the stream and handed to `rewrite` once the object is complete, and the members it returns are
+// appended before the closing brace. Everything else is copied through as it arrives, so large create bodies are never
+// held in memory as a whole. Key order does not matter to the upstream, so moving the rewritten members is fine.
+class JsonRewriter extends Transform {
+  constructor(keys, rewrite) {
+    super();
+    // Podman decodes the body case-insensitively, so "hostConfig" is captured as "HostConfig"
+    this.keys = new Map(keys.map((key) => [key.toLowerCase(), key]));
+    this.rewrite = rewrite;
+    this.decoder = new StringDecoder('utf8');
+    this.state = 'start';
+    this.position = 0;
+    this.first = true;
+    this.captured = {};
+    this.key = null;
+    this.keyRaw = '';
+    this.capture = false;
+    this.valueRaw = '';
+    this.depth = 0;
+    this.inString = false;
+    this.escaped = false;
+  }
+
+  _transform(chunk, encoding, callback) {
+    this.process(this.decoder.write(chunk)).then(() => callback(), callback);
+  }
+
+  _flush(callback) {
+    this.process(this.decoder.end())
+      .then(() => {
+        if (this.state !== 'trailing') {
+          throw this.error('unexpected end of JSON body');
+        }
+      })
+      .then(() => callback(), callback);
+  }
+
+  error(message) {
+    return new ProxyError(400, `invalid JSON body: ${message}`);
+  }
+
+  unexpected(char) {
+    return this.error(`unexpected ${JSON.stringify(char)} at position ${this.position}`);
+  }
+
+  async process(text) {
+    let out = '';
+    let segmentStart = -1; // Start of the pass-through value text in this chunk
+    for (let i = 0; i < text.length; i++, this.position++) {
+      const char = text[i];
+      switch (this.state) {
+        case 'start':
+          if (char === '{') {
+            out += char;
+            this.state = 'key-or-end';
+          } else if (!whitespace.includes(char)) {
+            throw this.error('expected an object');
+          }
+          break;
+
+        case 'key-or-end':
+        case 'key-start':
+          if (char === '"') {
+            this.keyRaw = char;
+            this.escaped = false;
+            this.state = 'key';
+          } else if (char === '}' && this.state === 'key-or-end') {
+            this.push(out);
+            out = '';
+            await this.closeObject();
+          } else if (!whitespace.includes(char)) {
+            throw this.unexpected(char);
+          }
+          break;
+
+        case 'key':
+          this.keyRaw += char;
+          if (this.escaped) {
+            this.escaped = false;
+          } else if (char === '\\') {
+            this.escaped = true;
+          } else if (char === '"') {
+            try {
+              this.key = JSON.parse(this.keyRaw);
+            } catch (err) {
+              throw this.error(`invalid key at position ${this.position}`);
+            }
+            this.state = 'colon';
+          }
+          break;
+
+        case 'colon':
+          if (char === ':') {
+            this.capture = this.keys.has(this.key.toLowerCase());
+            if (this.capture) {
+              const key = this.keys.get(this.key.toLowerCase());
+              // Either one could be the one that gets through otherwise
+              if (Object.hasOwn(this.captured, key)) {
+                throw this.error(`duplicate member ${JSON.stringify(this.key)}`);
+              }
+              this.key = key;
+            }
+            if (!this.capture) {
+              out += `${this.first ? '' : ','}${this.keyRaw}:`;
+              this.first = false;
+            }
+            this.valueRaw = '';
+            this.depth = 0;
+            this.inString = false;
+            this.escaped = false;
+            this.state = 'value-start';
+          } else if (!whitespace.includes(char)) {
+            throw this.unexpected(char);
+          }
+          break;
+
+        case 'value-start':
+        case 'value': {
+          if (this.state === 'value-start') {
+            if (whitespace.includes(char)) {
+              break;
+            }
+            if (char === ',' || char === '}' || char === ']' || char === ':') {
+              throw this.unexpected(char);
+            }
+            this.state = 'value';
+            segmentStart = i;
+          }
+          const end = this.scanValue(char);
+          if (end === 'before') {
+            // The delimiter after a number or literal is not part of the value
+            this.endValue(text, segmentStart, i, (s) => (out += s));
+            segmentStart = -1;
+            this.state = 'comma-or-end';
+            i--;
+            this.position--;
+          } else if (end === 'after') {
+            this.endValue(text, segmentStart, i + 1, (s) => (out += s));
+            segmentStart = -1;
+            this.state = 'comma-or-end';
+          }
+          break;
+        }
+
+        case 'comma-or-end':
+          if (char === ',') {
+            this.state = 'key-start';
+          } else if (char === '}') {
+            this.push(out);
+            out = '';
+            await this.closeObject();
+          } else if (!whitespace.includes(char)) {
+            throw this.unexpected(char);
+          }
+          break;
+
+        case 'trailing':
+          if (!whitespace.includes(char)) {
+            throw this.unexpected(char);
+          }
+          break;
+      }
+    }
+
+    // A value continues in the next chunk
+    if (this.state === 'value' && segmentStart >= 0) {
+      if (this.capture) {
+        this.valueRaw += text.slice(segmentStart);
+      } else {
+        out += text.slice(segmentStart);
+      }
+    } else if (this.state === 'value') {
+      if (this.capture) {
+        this.valueRaw += text;
+      } else {
+        out += text;
+      }
+    }
+    if (out) {
+      this.push(out);
+    }
+  }
+
+  // Returns whether the value ends before or after the given character, or null if it continues
+  scanValue(char) {
+    if (this.inString) {
+      if (this.escaped) {
+        this.escaped = false;
+      } else if (char === '\\') {
+        this.escaped = true;
+      } else if (char === '"') {
+        this.inString = false;
+        return this.depth === 0 ? 'after' : null;
+      }
+      return null;
+    }
+    if (char === '"') {
+      this.inString = true;
+    } else if (char === '{' || char === '[') {
+      this.depth++;
+    } else if (char === '}' || char === ']') {
+      if (this.depth === 0) {
+        return 'before';
+      }
+      this.depth--;
+      return this.depth === 0 ? 'after' : null;
+    } else if (this.depth === 0 && (char === ',' || whitespace.includes(char))) {
+      return 'before';
+    }
+    return null;
+  }
+
+  endValue(text, start, end, write) {
+    const part = start >= 0 ? text.slice(start, end) : text.slice(0, end);
+    if (!this.capture) {
+      write(part);
+      return;
+    }
+    const raw = this.valueRaw + part;
+    try {
+      this.captured[this.key] = JSON.parse(raw);
+    } catch (err) {
+      throw this.error(`invalid value of ${this.key}: ${err.message}`);
+    }
+  }
+
+  async closeObject() {
+    const members = await this.rewrite(this.captured);
+    let out = '';
+    for (const [key, value] of Object.entries(members)) {
+      if (value !== undefined) {
+        out += `${this.first ? '' : ','}${JSON.stringify(key)}:${JSON.stringify(value)}`;
+        this.first = false;
+      }
+    }
+    this.push(`${out}}`);
+    this.state = 'trailing';
+  }
+}
+
+// Renames the members of a nested object whose keys only differ in case from the given ones, like the JsonRewriter
+// does for the top-level members. Members given in several spellings are rejected.
+function canonicalizeKeys(object, keys) {
+  if (object === null || typeof object !== 'object' || Array.isArray(object)) {
+    return;
+  }
+  for (const key of keys) {
+    const variants = Object.keys(object).filter((name) => name !== key && name.toLowerCase() === key.toLowerCase());
+    if (!variants.length) {
+      continue;
+    }
+    if (variants.length > 1 || Object.hasOwn(object, key)) {
+      throw new ProxyError(400, `invalid JSON body: duplicate member ${JSON.stringify(variants[0])}`);
+    }
+    object[key] = object[variants[0]];
+    delete object[variants[0]];
+  }
+}
+
+module.exports = { JsonRewriter, canonicalizeKeys };
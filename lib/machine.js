@@ -0,0 +1,65 @@
+const { execFile } = require('child_process');
+
+const defaultPodmanPath = 'podman.exe';
+
+function runPodman(podmanPath, args, timeout) {
+  return new Promise((resolve, reject) => {
+    execFile(podmanPath, args, { timeout }, (err, stdout, stderr) => {
+      if (err) {
+        err.message = `${podmanPath} ${args.join(' ')} failed: ${(stderr || err.message).trim()}`;
+        err.stderr = stderr;
+        reject(err);
+      } else {
+        resolve(stdout);
+      }
+    });
+  });
+}
+
+// Starts the podman machine through WSL interop when the upstream is missing and waits for it to answer. Concurrent
+// callers share the same attempt, and after a failed attempt no new one is made for a minute, so a broken installation
+// does not spawn podman for every request.
+class MachineStarter {
+  constructor(podmanPath, machineName, waitForUpstream, timeout = 120) {
+    this.podmanPath = podmanPath;
+    this.machineName = machineName;
+    this.waitForUpstream = waitForUpstream;
+    this.timeout = timeout;
+    this.starting = null;
+    this.retryAfter = 0;
+  }
+
+  start() {
+    if (!this.starting) {
+      if (Date.now() < this.retryAfter) {
+        return Promise.reject(new Error(`starting machine ${this.machineName} failed recently`));
+      }
+      this.starting = this.run().finally(() => {
+        this.starting = null;
+      });
+    }
+    return this.starting;
+  }
+
+  async run() {
+    console.log(`Starting podman machine ${this.machineName}`);
+    try {
+      try {
+        await runPodman(this.podmanPath, ['machine', 'start', this.machineName], this.timeout * 1000);
+      } catch (err) {
+        // The machine may be running with its socket missing or just starting up
+        if (!/already running/i.test(err.stderr || '')) {
+          throw err;
+        }
+      }
+      await this.waitForUpstream(this.timeout);
+      console.log(`Podman machine ${this.machineName} is running`);
+    } catch (err) {
+      console.error(`Unable to start podman machine ${this.machineName}: ${err.message}`);
+      this.retryAfter = Date.now() + 60000;
+      throw err;
+    }
+  }
+}
+
+module.exports = { defaultPodmanPath, MachineStarter };
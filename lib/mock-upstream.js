@@ -0,0 +1,122 @@
+const crypto = require('crypto');
+const fs = require('fs');
+const http = require('http');
+const os = require('os');
+const path = require('path');
+
+const mockVersion = { Version: '5.0.0', ApiVersion: '1.41', MinAPIVersion: '1.24', Os: 'linux', Arch: 'amd64' };
+
+// The oldest requests are dropped beyond this many
+const maxRecordedRequests = 1000;
+
+function getPathWithoutVersion(reqUrl) {
+  return new URL(reqUrl, 'http://mock').pathname.replace(/^\/v\d+(?:\.\d+)*\//, '/');
+}
+
+function parseBody(body) {
+  if (!body) {
+    return null;
+  }
+  try {
+    return JSON.parse(body);
+  } catch (err) {
+    return body;
+  }
+}
+
+// Just enough of the podman API for clients to get through their usual calls: pings and versions, container creation
+// and the lifecycle endpoints succeed, lists are empty and everything else answers with an empty object.
+function getMockResponse(method, apiPath) {
+  const basePath = apiPath.replace(/^\/libpod\//, '/');
+  if (basePath === '/_ping') {
+    return { statusCode: 200, contentType: 'text/plain', body: 'OK' };
+  }
+  if (basePath === '/version') {
+    return { statusCode: 200, body: mockVersion };
+  }
+  if (method === 'POST' && /\/create$/.test(basePath)) {
+    const id = crypto.randomBytes(32).toString('hex');
+    return { statusCode: 201, body: { Id: id, Warnings: [] } };
+  }
+  if (method === 'DELETE' || /\/(start|stop|kill|restart|pause|unpause)$/.test(basePath)) {
+    return { statusCode: 204 };
+  }
+  if (method === 'GET' && basePath.endsWith('/json')) {
+    return { statusCode: 200, body: [] };
+  }
+  return { statusCode: 200, body: {} };
+}
+
+// A fake podman API on a Unix socket, which records the requests it receives, i.e. as translated by the proxy
+class MockUpstream {
+  constructor(socketPath = path.join(os.tmpdir(), `podman-wsl-service-mock-${process.pid}.sock`)) {
+    this.socketPath = socketPath;
+    this.requests = [];
+    this.server = http.createServer((req, res) => this.handleRequest(req, res));
+    this.server.on('upgrade', (req, socket, head) => this.handleUpgrade(req, socket, head));
+  }
+
+  start() {
+    if (fs.existsSync(this.socketPath)) {
+      fs.unlinkSync(this.socketPath);
+    }
+    this.server.listen(this.socketPath, () => {
+      console.log(`Mock upstream is listening on ${this.socketPath}`);
+    });
+  }
+
+  stop() {
+    this.server.close();
+    if (fs.existsSync(this.socketPath)) {
+      fs.unlinkSync(this.socketPath);
+    }
+  }
+
+  record(req, body) {
+    this.requests.push({
+      time: new Date().toISOString(),
+      method: req.method,
+      url: req.url,
+      headers: req.headers,
+      body: parseBody(body),
+    });
+    if (this.requests.length > maxRecordedRequests) {
+      this.requests.shift();
+    }
+  }
+
+  handleRequest(req, res) {
+    const chunks = [];
+    req.on('data', (chunk) => chunks.push(chunk));
+    req.on('end', () => {
+      this.record(req, Buffer.concat(chunks).toString());
+      const response = getMockResponse(req.method, getPathWithoutVersion(req.url));
+      console.debug(`Mock upstream: ${response.statusCode} ${req.method} ${req.url}`);
+      if (response.body === undefined) {
+        res.writeHead(response.statusCode);
+        res.end();
+        return;
+      }
+      const contentType = response.contentType || 'application/json';
+      res.writeHead(response.statusCode, { 'Content-Type': contentType, 'Api-Version': mockVersion.ApiVersion });
+      res.end(contentType === 'application/json' ? JSON.stringify(response.body) : response.body);
+    });
+  }
+
+  // Attach and exec sessions echo what the client sends
+  handleUpgrade(req, socket, head) {
+    this.record(req, null);
+    socket.write(
+      'HTTP/1.1 101 UPGRADED\r\n' +
+        'Content-Type: application/vnd.docker.raw-stream\r\n' +
+        'Connection: Upgrade\r\n' +
+        `Upgrade: ${req.headers.upgrade || 'tcp'}\r\n\r\n`
+    );
+    if (head.length) {
+      socket.write(head);
+    }
+    socket.pipe(socket);
+  }
+}
+
+module.exports = { MockUpstream };
@@ -0,0 +1,87 @@
+const path = require('path');
+const { MountDeniedError } = require('./errors');
+const { isSubpath, normalizePath, resolveRealPath } = require('./paths');
+
+// Entries match the given path and everything below it, unless prefixed with "=" to match the exact path only.
+// The most specific matching entry wins; on a tie, deny wins.
+function compileMountPolicy(policy) {
+  if (policy === undefined) {
+    return null;
+  }
+  if (policy === null || typeof policy !== 'object' || Array.isArray(policy)) {
+    throw new Error('"mountPolicy" must be an object');
+  }
+  const defaultAction = policy.default || 'allow';
+  if (defaultAction !== 'allow' && defaultAction !== 'deny') {
+    throw new Error('"mountPolicy.default" must be "allow" or "deny"');
+  }
+  // Denied mounts either fail the request or are replaced with an empty named volume
+  const onDeny = policy.onDeny || 'reject';
+  if (onDeny !== 'reject' && onDeny !== 'volume') {
+    throw new Error('"mountPolicy.onDeny" must be "reject" or "volume"');
+  }
+
+  const entries = [];
+  for (const action of ['allow', 'deny']) {
+    const paths = policy[action] || [];
+    if (!Array.isArray(paths)) {
+      throw new Error(`"mountPolicy.${action}" must be an array`);
+    }
+    for (const entry of paths) {
+      if (typeof entry !== 'string') {
+        throw new Error(`"mountPolicy.${action}" entries must be strings`);
+      }
+      const exact = entry.startsWith('=');
+      const entryPath = normalizePath(exact ? entry.slice(1) : entry);
+      if (!entryPath.startsWith('/')) {
+        throw new Error(`"mountPolicy.${action}" entries must be absolute paths: ${entry}`);
+      }
+      entries.push({ action, exact, path: resolveEntryPath(entryPath) });
+    }
+  }
+
+  return { defaultAction, onDeny, entries };
+}
+
+// Sources are checked with their symlinks resolved, so entries like /var/run are resolved the same way (to /run)
+function resolveEntryPath(entryPath) {
+  try {
+    return resolveRealPath(entryPath);
+  } catch (err) {
+    return entryPath;
+  }
+}
+
+function matchesEntry(entry, hostPath) {
+  return entry.exact ? hostPath === entry.path : isSubpath(hostPath, entry.path);
+}
+
+function getMountPolicyAction(policy, hostPath) {
+  if (!policy) {
+    return 'allow';
+  }
+  const normalized = path.posix.resolve(hostPath);
+  let best = null;
+  let bestRank = -1;
+  for (const entry of policy.entries) {
+    if (!matchesEntry(entry, normalized)) {
+      continue;
+    }
+    const rank = entry.path.length * 4 + (entry.exact ? 2 : 0) + (entry.action === 'deny' ? 1 : 0);
+    if (rank > bestRank) {
+      best = entry;
+      bestRank = rank;
+    }
+  }
+  return best ? best.action : policy.defaultAction;
+}
+
+// The source is the path as the client sent it, if it resolved to another one
+function checkMountPolicy(policy, hostPath, source = hostPath) {
+  if (getMountPolicyAction(policy, hostPath) === 'deny') {
+    const resolved = source !== hostPath ? ` (resolved to '${hostPath}')` : '';
+    throw new MountDeniedError(`bind mount source '${source}'${resolved} is denied by the mount policy`);
+  }
+}
+
+module.exports = { compileMountPolicy, getMountPolicyAction, checkMountPolicy };
@@ -0,0 +1,44 @@
+const fs = require('fs');
+const { isSubpath, normalizePath } = require('./paths');
+
+// Mount points in mountinfo escape spaces, tabs, newlines and backslashes as octal sequences
+function unescapeField(field) {
+  return field.replace(/\\([0-7]{3})/g, (_, octal) => String.fromCharCode(parseInt(octal, 8)));
+}
+
+function readMountInfo() {
+  return fs
+    .readFileSync('/proc/self/mountinfo', 'utf8')
+    .split('\n')
+    .filter(Boolean)
+    .map((line) => {
+      const fields = line.split(' ');
+      const separator = fields.indexOf('-');
+      return {
+        id: fields[0],
+        parentId: fields[1],
+        device: fields[2],
+        root: unescapeField(fields[3]),
+        mountPoint: unescapeField(fields[4]),
+        options: fields[5],
+        optionalFields: fields.slice(6, separator),
+        fsType: fields[separator + 1],
+        source: unescapeField(fields[separator + 2]),
+        superOptions: fields[separator + 3],
+      };
+    });
+}
+
+// Returns the mount the given absolute path lives on. Later entries shadow earlier ones.
+function getMountForPath(hostPath, mounts = readMountInfo()) {
+  const normalized = normalizePath(hostPath);
+  let best = null;
+  for (const mount of mounts) {
+    if (isSubpath(normalized, mount.mountPoint) && (!best || mount.mountPoint.length >= best.mountPoint.length)) {
+      best = mount;
+    }
+  }
+  return best;
+}
+
+module.exports = { readMountInfo, getMountForPath };
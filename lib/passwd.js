@@ -0,0 +1,46 @@
+const fs = require('fs');
+
+function readDatabase(file) {
+  try {
+    return fs
+      .readFileSync(file, 'utf8')
+      .split('\n')
+      .filter((line) => line && !line.startsWith('#'))
+      .map((line) => line.split(':'));
+  } catch (err) {
+    return [];
+  }
+}
+
+function getUserName(uid) {
+  const entry = readDatabase('/etc/passwd').find((fields) => parseInt(fields[2]) === uid);
+  return entry ? entry[0] : String(uid);
+}
+
+// Falls back to a group with the same ID as the user
+function getUserGid(uid) {
+  const entry = readDatabase('/etc/passwd').find((fields) => parseInt(fields[2]) === uid);
+  return entry ? parseInt(entry[3]) : uid;
+}
+
+// Accepts either a numeric ID or a name
+function resolveId(file, value, kind) {
+  if (/^\d+$/.test(value)) {
+    return parseInt(value);
+  }
+  const entry = readDatabase(file).find((fields) => fields[0] === value);
+  if (!entry) {
+    throw new Error(`Unknown ${kind}: ${value}`);
+  }
+  return parseInt(entry[2]);
+}
+
+function resolveUid(value) {
+  return resolveId('/etc/passwd', value, 'user');
+}
+
+function resolveGid(value) {
+  return resolveId('/etc/group', value, 'group');
+}
+
+module.exports = { getUserName, getUserGid, resolveUid, resolveGid };
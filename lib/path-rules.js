@@ -0,0 +1,31 @@
+// Rules are final by default: the rewritten path is used as-is. Non-final rules hand the rewritten path over to the
+// default shared-root translation.
+function compilePathRules(rules) {
+  if (rules === undefined) {
+    return [];
+  }
+  if (!Array.isArray(rules)) {
+    throw new Error('"pathRules" must be an array');
+  }
+  return rules.map((rule, i) => {
+    if (typeof rule.match !== 'string' || typeof rule.replace !== 'string') {
+      throw new Error(`pathRules[${i}]: "match" and "replace" must be strings`);
+    }
+    return {
+      regex: new RegExp(rule.match),
+      replace: rule.replace,
+      final: rule.final !== false,
+    };
+  });
+}
+
+function applyPathRules(rules, hostPath) {
+  for (const rule of rules) {
+    if (rule.regex.test(hostPath)) {
+      return { path: hostPath.replace(rule.regex, rule.replace), final: rule.final };
+    }
+  }
+  return null;
+}
+
+module.exports = { compilePathRules, applyPathRules };
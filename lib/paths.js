@@ -0,0 +1,44 @@
+const fs = require('fs');
+const path = require('path');
+
+// Whether the path equals the parent or lives below it. Both paths must be normalized.
+function isSubpath(hostPath, parent) {
+  return hostPath === parent || parent === '/' || hostPath.startsWith(`${parent}/`);
+}
+
+// Normalizes an absolute path and strips trailing slashes
+function normalizePath(hostPath) {
+  const normalized = path.posix.normalize(hostPath);
+  return normalized.length > 1 ? normalized.replace(/\/+$/, '') : normalized;
+}
+
+// Resolves the symlinks of an absolute path, e.g. /proc/1/root/etc to /etc. The components that do not exist (yet)
+// are appended to the resolved path of the deepest one that does; other errors, e.g. EACCES, are thrown.
+function resolveRealPath(hostPath) {
+  let existing = path.posix.resolve(hostPath);
+  const missing = [];
+  for (;;) {
+    try {
+      return path.posix.join(fs.realpathSync(existing), ...missing);
+    } catch (err) {
+      if (err.code !== 'ENOENT' && err.code !== 'ENOTDIR') {
+        throw err;
+      }
+      missing.unshift(path.posix.basename(existing));
+      existing = path.posix.dirname(existing);
+    }
+  }
+}
+
+// Replaces the placeholders with the given keys, e.g. %u, and %% with a percent sign. Other percent signs are left
+// alone, as addresses may be URL-encoded.
+function expandPlaceholders(value, placeholders) {
+  if (typeof value !== 'string') {
+    return value;
+  }
+  return value.replace(/%([%\w])/g, (match, key) =>
+    key === '%' ? '%' : Object.hasOwn(placeholders, key) ? placeholders[key] : match
+  );
+}
+
+module.exports = { isSubpath, normalizePath, resolveRealPath, expandPlaceholders };
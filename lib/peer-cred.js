@@ -0,0 +1,191 @@
+const fs = require('fs');
+const { execFile } = require('child_process');
+const { getUserName } = require('./passwd');
+
+// Node does not expose SO_PEERCRED, so the peer process is looked up through sock_diag (via ss), matching the peer
+// inode of our end of the connection. This is the process that holds the other end now, which is not necessarily the
+// one that connected, so every lookup that could be ambiguous gives no credentials at all.
+function getSocketInode(socket) {
+  const fd = socket._handle && socket._handle.fd;
+  if (typeof fd !== 'number' || fd < 0) {
+    return null;
+  }
+  const match = fs.readlinkSync(`/proc/self/fd/${fd}`).match(/^socket:\[(\d+)]$/);
+  return match ? match[1] : null;
+}
+
+// The addresses may contain spaces, so the inodes are taken from the ends: the last field before the process list is
+// the inode of the peer. Unbound sockets have "*" as their address.
+function parseSocketLine(line) {
+  const processStart = line.indexOf(' users:(');
+  const fields = (processStart >= 0 ? line.slice(0, processStart) : line).trim().split(/\s+/);
+  const end = fields.findIndex((field, i) => i >= 4 && /^(<->|->|<-|ino:.*)$/.test(field));
+  const addressFields = fields.slice(0, end >= 0 ? end : fields.length);
+  const processList = processStart >= 0 ? line.slice(processStart) : '';
+  const processes = [...processList.matchAll(/\("((?:[^"\\]|\\.)*)",pid=(\d+),/g)];
+  return {
+    fields: addressFields.slice(4),
+    peerInode: addressFields[addressFields.length - 1],
+    processes: processes.map((match) => ({ name: match[1], pid: parseInt(match[2]) })),
+  };
+}
+
+function listUnixSockets() {
+  return new Promise((resolve, reject) => {
+    execFile('ss', ['-xpnH'], { maxBuffer: 16 * 1024 * 1024 }, (err, stdout) => {
+      if (err) {
+        reject(err.code === 'ENOENT' ? new Error('ss (iproute2) is needed to identify the clients') : err);
+        return;
+      }
+      resolve(stdout.split('\n').filter((line) => line.trim()).map(parseSocketLine));
+    });
+  });
+}
+
+// Our end lists our inode followed by the one of the peer, the end of the peer the other way round. Anything but
+// exactly one of each is ambiguous.
+function findPeer(sockets, inode) {
+  const own = sockets.filter((s) => s.peerInode !== inode && s.fields.slice(0, -1).includes(inode));
+  if (own.length !== 1) {
+    return null;
+  }
+  const peerInode = own[0].peerInode;
+  const peers = sockets.filter((s) => s.peerInode === inode && s.fields.slice(0, -1).includes(peerInode));
+  return peers.length === 1 ? { ...peers[0], inode: peerInode } : null;
+}
+
+// The process must still hold the socket, so that a PID reused in the meantime is not taken for the client
+function holdsSocket(pid, inode) {
+  return fs.readdirSync(`/proc/${pid}/fd`).some((fd) => {
+    try {
+      return fs.readlinkSync(`/proc/${pid}/fd/${fd}`) === `socket:[${inode}]`;
+    } catch (err) {
+      return false;
+    }
+  });
+}
+
+function readProcessStatus(pid) {
+  const status = {};
+  for (const line of fs.readFileSync(`/proc/${pid}/status`, 'utf8').split('\n')) {
+    const index = line.indexOf(':');
+    if (index > 0) {
+      status[line.slice(0, index)] = line.slice(index + 1).trim();
+    }
+  }
+  return status;
+}
+
+// The arguments are separated by NUL bytes; the ones with spaces are quoted so the command line can be read back
+function readCommandLine(pid) {
+  return fs
+    .readFileSync(`/proc/${pid}/cmdline`, 'utf8')
+    .split('\0')
+    .filter((arg, i, args) => i < args.length - 1 || arg)
+    .map((arg) => (/\s/.test(arg) || !arg ? JSON.stringify(arg) : arg))
+    .join(' ');
+}
+
+// The innermost systemd service or scope of the process, e.g. the session scope of a shell
+function readSystemdUnit(pid) {
+  for (const line of fs.readFileSync(`/proc/${pid}/cgroup`, 'utf8').split('\n')) {
+    const match = line.match(/^(?:0:|\d+:name=systemd):(.*)$/);
+    const unit = match && match[1].split('/').reverse().find((name) => /\.(service|scope)$/.test(name));
+    if (unit) {
+      return unit;
+    }
+  }
+  return null;
+}
+
+// The process may be gone already, or belong to a user whose /proc entries cannot be read
+function tryRead(read, pid) {
+  try {
+    return read(pid) || null;
+  } catch (err) {
+    return null;
+  }
+}
+
+// The real, effective, saved and filesystem IDs of the process
+function readIds(value) {
+  const ids = (value || '').split(/\s+/).filter(Boolean).map(Number);
+  return ids.length === 4 && ids.every((id) => id === ids[0]) ? ids[0] : null;
+}
+
+async function lookupPeerCredentials(socket) {
+  // TCP clients cannot be identified
+  if (socket.remoteAddress) {
+    return null;
+  }
+  const inode = getSocketInode(socket);
+  if (!inode) {
+    return null;
+  }
+  const peer = findPeer(await listUnixSockets(), inode);
+  if (!peer) {
+    console.debug(`Unable to find the peer of socket ${inode}`);
+    return null;
+  }
+  // e.g. after a fork, or when the socket was passed to another process
+  const pids = [...new Set(peer.processes.map((process) => process.pid))];
+  if (pids.length !== 1) {
+    console.debug(`The peer of socket ${inode} is held by ${pids.length} processes, not identifying it`);
+    return null;
+  }
+
+  const pid = pids[0];
+  const status = tryRead(readProcessStatus, pid);
+  if (!status || !tryRead((p) => holdsSocket(p, peer.inode), pid)) {
+    return null;
+  }
+  // A process that changed its IDs, e.g. by running a setuid program, may not be the user that connected
+  const uid = readIds(status.Uid);
+  const gid = readIds(status.Gid);
+  if (uid === null || gid === null) {
+    console.debug(`PID ${pid} has mixed user or group IDs, not identifying it`);
+    return null;
+  }
+  const program = peer.processes[0].name;
+  return {
+    pid,
+    uid,
+    user: getUserName(uid),
+    gid,
+    groups: (status.Groups || '').split(/\s+/).filter(Boolean).map(Number),
+    program,
+    command: tryRead(readCommandLine, pid) || program,
+    executable: tryRead((p) => fs.readlinkSync(`/proc/${p}/exe`), pid),
+    unit: tryRead(readSystemdUnit, pid),
+  };
+}
+
+function describeClient(cred) {
+  const unit = cred.unit ? `, unit ${cred.unit}` : '';
+  const executable = cred.executable ? ` (${cred.executable})` : '';
+  return `${cred.user} (UID ${cred.uid}), PID ${cred.pid}${unit}: ${cred.command}${executable}`;
+}
+
+// The lookup is done once per connection, the requests of keep-alive connections and HTTP/2 sessions share it
+const lookups = new WeakMap();
+
+function getPeerCredentials(socket) {
+  if (!lookups.has(socket)) {
+    const lookup = lookupPeerCredentials(socket).then(
+      (cred) => {
+        if (cred) {
+          console.debug(`Client of the connection: ${describeClient(cred)}`);
+        }
+        return cred;
+      },
+      (err) => {
+        console.error(`Unable to get the client credentials: ${err.message}`);
+        return null;
+      }
+    );
+    lookups.set(socket, lookup);
+  }
+  return lookups.get(socket);
+}
+
+module.exports = { getPeerCredentials };
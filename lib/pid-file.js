@@ -0,0 +1,69 @@
+const fs = require('fs');
+const path = require('path');
+
+const defaultPidFilePath = '/run/podman-wsl-service.pid';
+
+function isRunning(pid) {
+  try {
+    process.kill(pid, 0);
+    return true;
+  } catch (err) {
+    // EPERM: the process exists but belongs to another user
+    return err.code === 'EPERM';
+  }
+}
+
+// Returns the PID of the instance holding the PID file, or null if there is none or it is gone
+function getRunningPid(pidFilePath) {
+  let pid;
+  try {
+    pid = parseInt(fs.readFileSync(pidFilePath, 'utf8'));
+  } catch (err) {
+    return null;
+  }
+  return pid > 0 && pid !== process.pid && isRunning(pid) ? pid : null;
+}
+
+class AlreadyRunningError extends Error {
+  constructor(pid) {
+    super(`another instance is already running with PID ${pid}`);
+    this.pid = pid;
+  }
+}
+
+// The PID file doubles as the lock against a second instance: it is created exclusively, and only replaced when the
+// process it names is gone, e.g. after a crash, or is the predecessor handing over to this process.
+function acquirePidFile(pidFilePath, predecessorPid = null) {
+  fs.mkdirSync(path.dirname(pidFilePath), { recursive: true });
+  for (let attempt = 0; ; attempt++) {
+    try {
+      fs.writeFileSync(pidFilePath, `${process.pid}\n`, { flag: 'wx' });
+      return;
+    } catch (err) {
+      if (err.code !== 'EEXIST') {
+        throw err;
+      }
+      const pid = getRunningPid(pidFilePath);
+      if (pid && pid !== predecessorPid) {
+        throw new AlreadyRunningError(pid);
+      }
+      if (attempt > 0) {
+        throw err;
+      }
+    }
+    fs.unlinkSync(pidFilePath);
+  }
+}
+
+// Only removes the PID file if it is the one of this process
+function releasePidFile(pidFilePath) {
+  try {
+    if (parseInt(fs.readFileSync(pidFilePath, 'utf8')) === process.pid) {
+      fs.unlinkSync(pidFilePath);
+    }
+  } catch (err) {
+    // Already gone
+  }
+}
+
+module.exports = { defaultPidFilePath, AlreadyRunningError, getRunningPid, acquirePidFile, releasePidFile };
@@ -0,0 +1,53 @@
+const { spawn } = require('child_process');
+
+const defaultPipeBridgePath = 'winsocat.exe';
+
+function getDefaultPipeName(distroName) {
+  return `podman-wsl-${distroName}`;
+}
+
+// Exposes a downstream socket to Windows as \\.\pipe\<name>. The bridge runs on Windows through interop, listens on
+// the pipe and relays every connection to the socket with socat, run in the distro by wsl.exe. Like the tunnels, it is
+// restarted when it exits.
+class PipeBridge {
+  constructor(bridgePath, pipeName, distroName, userName, socketPath) {
+    this.bridgePath = bridgePath;
+    this.pipeName = pipeName;
+    this.relay = `wsl.exe -d ${distroName} -u ${userName} -e socat - UNIX-CONNECT:${socketPath}`;
+    this.process = null;
+    this.restartTimer = null;
+    this.stopped = false;
+  }
+
+  start() {
+    this.spawn();
+  }
+
+  spawn() {
+    console.log(`Exposing the API to Windows as \\\\.\\pipe\\${this.pipeName}`);
+    let stderr = '';
+    this.process = spawn(this.bridgePath, [`NPIPE-LISTEN:${this.pipeName}`, `EXEC:${this.relay}`], {
+      stdio: ['ignore', 'ignore', 'pipe'],
+    });
+    this.process.stderr.on('data', (chunk) => (stderr += chunk));
+    this.process.on('error', (err) => console.error(`Unable to run ${this.bridgePath}: ${err.message}`));
+    this.process.on('close', (code) => {
+      this.process = null;
+      if (this.stopped) {
+        return;
+      }
+      console.error(`Named pipe bridge exited with code ${code}: ${stderr.trim()}`);
+      this.restartTimer = setTimeout(() => this.spawn(), 5000);
+    });
+  }
+
+  stop() {
+    this.stopped = true;
+    clearTimeout(this.restartTimer);
+    if (this.process) {
+      this.process.kill();
+    }
+  }
+}
+
+module.exports = { defaultPipeBridgePath, getDefaultPipeName, PipeBridge };
@@ -0,0 +1,73 @@
+const { hopByHopHeaders, requestUpstream } = require('./upstream');
+
+// Clients such as Docker Compose ask for these before every operation, and the answers only change when the machine
+// does. The versioned paths are not listed, the prefix is removed before the lookup.
+const cacheablePaths = ['/_ping', '/version', '/libpod/_ping', '/libpod/version'];
+
+// IDE extensions poll these every second or so. They change with every container and image, so they are only cached
+// when asked for, and dropped whenever a change goes through the service.
+const listPaths = ['/containers/json', '/images/json', '/libpod/containers/json', '/libpod/images/json'];
+
+// Caches the responses to version and ping requests, and optionally to container and image lists, for a few seconds.
+// Concurrent requests share the upstream request.
+class ResponseCache {
+  constructor(ttl, listTtl = 0) {
+    this.ttl = ttl;
+    this.listTtl = listTtl;
+    this.entries = new Map();
+  }
+
+  getTtl(pathWithoutVersion) {
+    if (cacheablePaths.includes(pathWithoutVersion)) {
+      return this.ttl;
+    }
+    return listPaths.includes(pathWithoutVersion) ? this.listTtl : 0;
+  }
+
+  isCacheable(method, pathWithoutVersion) {
+    return (method === 'GET' || method === 'HEAD') && this.getTtl(pathWithoutVersion) > 0;
+  }
+
+  // Resolves to the response and whether it came from the cache. Failed requests and errors are not cached.
+  async get(address, method, apiPath, pathWithoutVersion) {
+    const key = `${address} ${method} ${apiPath}`;
+    const entry = this.entries.get(key);
+    if (entry && entry.expires > Date.now()) {
+      return { ...(await entry.response), cached: true };
+    }
+    const response = requestUpstream(address, method, apiPath).then((res) => {
+      hopByHopHeaders.forEach((name) => delete res.headers[name]);
+      delete res.headers['transfer-encoding'];
+      delete res.headers['date'];
+      return res;
+    });
+    const list = listPaths.includes(pathWithoutVersion);
+    this.entries.set(key, { response, list, expires: Date.now() + this.getTtl(pathWithoutVersion) * 1000 });
+    try {
+      const res = await response;
+      if (res.statusCode >= 400) {
+        this.entries.delete(key);
+      }
+      return { ...res, cached: false };
+    } catch (err) {
+      this.entries.delete(key);
+      throw err;
+    }
+  }
+
+  // Called when the upstream changed, e.g. because the machine was restarted
+  clear() {
+    this.entries.clear();
+  }
+
+  // Called for every request that may change the containers or images
+  clearLists() {
+    for (const [key, entry] of this.entries) {
+      if (entry.list) {
+        this.entries.delete(key);
+      }
+    }
+  }
+}
+
+module.exports = { ResponseCache };
@@ -0,0 +1,137 @@
+const crypto = require('crypto');
+const fs = require('fs');
+const os = require('os');
+const path = require('path');
+const { requestUpstream, requestUpstreamJson } = require('./upstream');
+
+const containerDir = '/selftest';
+
+async function pingService(socketPath) {
+  let res;
+  try {
+    res = await requestUpstream(socketPath, 'GET', '/_ping', { timeout: 5000 });
+  } catch (err) {
+    throw new Error(`${socketPath} is not answering (${err.message}), is the service running?`);
+  }
+  if (res.statusCode !== 200) {
+    throw new Error(`the ping failed with status ${res.statusCode}: ${res.body}`);
+  }
+  return `${socketPath} answers`;
+}
+
+// Pulls fail with status 200 too, the error is in the progress stream
+async function ensureImage(socketPath, image) {
+  const inspect = await requestUpstream(socketPath, 'GET', `/images/${image}/json`);
+  if (inspect.statusCode === 200) {
+    return `${image} is present`;
+  }
+  const res = await requestUpstream(socketPath, 'POST', `/images/create?fromImage=${encodeURIComponent(image)}`);
+  const progress = res.body
+    .split('\n')
+    .map((line) => {
+      try {
+        return JSON.parse(line);
+      } catch (err) {
+        return null;
+      }
+    })
+    .find((event) => event && event.error);
+  if (res.statusCode >= 400 || progress) {
+    throw new Error(`unable to pull ${image}: ${progress ? progress.error : res.body.trim()}`);
+  }
+  return `pulled ${image}`;
+}
+
+// Checks the whole chain through the downstream socket of a running service: a container with a bind mount of a
+// temporary directory of the distro writes a file into it, which must then show up in the distro. The stages after a
+// failed one are skipped, but the container and the directory are removed in any case.
+async function runSelfTest(socketPath, image) {
+  const token = crypto.randomBytes(8).toString('hex');
+  const state = { dir: null, container: null };
+  const stages = [
+    ['Service', () => pingService(socketPath)],
+    ['Image', () => ensureImage(socketPath, image)],
+    [
+      'Directory',
+      () => {
+        state.dir = fs.mkdtempSync(path.join(os.tmpdir(), 'podman-wsl-selftest-'));
+        // The user in the container may be mapped to another one in the distro
+        fs.chmodSync(state.dir, 0o777);
+        return `created ${state.dir}`;
+      },
+    ],
+    [
+      'Container',
+      async () => {
+        const created = await requestUpstreamJson(socketPath, 'POST', '/containers/create', {
+          Image: image,
+          Cmd: ['sh', '-c', `echo ${token} > ${containerDir}/probe`],
+          Labels: { 'podman-wsl-service.selftest': 'true' },
+          HostConfig: { Binds: [`${state.dir}:${containerDir}`] },
+        });
+        state.container = created.Id;
+        return `created ${state.container.slice(0, 12)} with a bind mount of ${state.dir}`;
+      },
+    ],
+    [
+      'Run',
+      async () => {
+        await requestUpstreamJson(socketPath, 'POST', `/containers/${state.container}/start`);
+        const result = await requestUpstreamJson(socketPath, 'POST', `/containers/${state.container}/wait`);
+        if (result && result.StatusCode) {
+          throw new Error(`the container exited with code ${result.StatusCode}`);
+        }
+        return `wrote ${containerDir}/probe in the container`;
+      },
+    ],
+    [
+      'Bind mount',
+      () => {
+        const probePath = path.join(state.dir, 'probe');
+        let content;
+        try {
+          content = fs.readFileSync(probePath, 'utf8').trim();
+        } catch (err) {
+          throw new Error(`${probePath} did not appear in the distro, the bind mount does not reach it`);
+        }
+        if (content !== token) {
+          throw new Error(`${probePath} has unexpected content: ${content}`);
+        }
+        return `${probePath} appeared in the distro`;
+      },
+    ],
+  ];
+
+  let passed = true;
+  for (const [name, run] of stages) {
+    if (!passed) {
+      console.info(`SKIP ${name}`);
+      continue;
+    }
+    try {
+      console.info(`OK   ${name}: ${await run()}`);
+    } catch (err) {
+      console.info(`FAIL ${name}: ${err.message}`);
+      passed = false;
+    }
+  }
+
+  try {
+    const removed = [];
+    if (state.container) {
+      await requestUpstreamJson(socketPath, 'DELETE', `/containers/${state.container}?force=true`);
+      removed.push('the container');
+    }
+    if (state.dir) {
+      fs.rmSync(state.dir, { recursive: true, force: true });
+      removed.push('the directory');
+    }
+    console.info(`OK   Cleanup: ${removed.length ? `removed ${removed.join(' and ')}` : 'nothing to remove'}`);
+  } catch (err) {
+    console.info(`FAIL Cleanup: ${err.message}`);
+    passed = false;
+  }
+  return passed;
+}
+
+module.exports = { runSelfTest };
@@ -0,0 +1,35 @@
+const { isSubpath, normalizePath } = require('./paths');
+
+const translationFailureModes = ['strict', 'pass-through', 'drop-mount', 'copy-to-volume'];
+
+function validateMode(mode, name) {
+  if (!translationFailureModes.includes(mode)) {
+    throw new Error(`${name} must be one of ${translationFailureModes.join(', ')}: ${mode}`);
+  }
+}
+
+// The "translationFailureModes" config section maps path prefixes to the mode used for sources below them
+function compileTranslationFailureModes(defaultMode, prefixModes) {
+  validateMode(defaultMode, 'The translation failure mode');
+  if (prefixModes === undefined) {
+    return { defaultMode, prefixes: [] };
+  }
+  if (prefixModes === null || typeof prefixModes !== 'object' || Array.isArray(prefixModes)) {
+    throw new Error('"translationFailureModes" must be an object');
+  }
+  const prefixes = Object.entries(prefixModes).map(([prefix, mode]) => {
+    validateMode(mode, `"translationFailureModes.${prefix}"`);
+    return { prefix: normalizePath(prefix), mode };
+  });
+  // Most specific prefix first
+  prefixes.sort((a, b) => b.prefix.length - a.prefix.length);
+  return { defaultMode, prefixes };
+}
+
+function getTranslationFailureMode(modes, hostPath) {
+  const normalized = normalizePath(hostPath);
+  const match = modes.prefixes.find((entry) => isSubpath(normalized, entry.prefix));
+  return match ? match.mode : modes.defaultMode;
+}
+
+module.exports = { translationFailureModes, compileTranslationFailureModes, getTranslationFailureMode };
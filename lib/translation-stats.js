@@ -0,0 +1,45 @@
+const outcomes = ['sharedRoot', 'windowsPath', 'excluded', 'failed'];
+
+const outcomeDescriptions = {
+  sharedRoot: 'to the shared root',
+  windowsPath: 'to Windows paths',
+  excluded: 'excluded',
+  failed: 'failed',
+};
+
+// Counts the outcome of every bind source translation per API, so setups where nothing ever reaches the shared root
+// stand out
+class TranslationStats {
+  constructor() {
+    this.counts = {};
+    this.summarized = {};
+  }
+
+  record(api, outcome) {
+    if (!this.counts[api]) {
+      this.counts[api] = Object.fromEntries(outcomes.map((name) => [name, 0]));
+    }
+    this.counts[api][outcome]++;
+  }
+
+  getStats() {
+    return JSON.parse(JSON.stringify(this.counts));
+  }
+
+  // One line per API with new translations since the last summary, with the totals since the start
+  summarize() {
+    const lines = [];
+    for (const [api, counts] of Object.entries(this.counts)) {
+      const total = outcomes.reduce((sum, name) => sum + counts[name], 0);
+      if (total === this.summarized[api]) {
+        continue;
+      }
+      this.summarized[api] = total;
+      const details = outcomes.map((name) => `${counts[name]} ${outcomeDescriptions[name]}`).join(', ');
+      lines.push(`Bind sources translated (${api}): ${total} in total, ${details}`);
+    }
+    return lines;
+  }
+}
+
+module.exports = { TranslationStats };
@@ -0,0 +1,138 @@
+const fs = require('fs');
+const os = require('os');
+const path = require('path');
+const { spawn } = require('child_process');
+
+const defaultRemoteSocketPath = '/run/podman/podman.sock';
+
+// Parses ssh://[user@]host[:port][/path/to/podman.sock], the same format podman-remote uses for connections
+function parseSshAddress(address) {
+  let url;
+  try {
+    url = new URL(address);
+  } catch (err) {
+    throw new Error(`invalid upstream address ${address}`);
+  }
+  if (url.protocol !== 'ssh:' || !url.hostname) {
+    throw new Error(`invalid upstream address ${address}, expected ssh://[user@]host[:port]/path`);
+  }
+  return {
+    user: decodeURIComponent(url.username),
+    host: url.hostname,
+    port: url.port ? parseInt(url.port) : null,
+    remotePath: url.pathname && url.pathname !== '/' ? decodeURIComponent(url.pathname) : defaultRemoteSocketPath,
+  };
+}
+
+// Parses vsock://<cid>:<port>
+function parseVsockAddress(address) {
+  const match = /^vsock:\/\/(\d+):(\d+)\/?$/.exec(address);
+  if (!match) {
+    throw new Error(`invalid upstream address ${address}, expected vsock://<cid>:<port>`);
+  }
+  return { cid: parseInt(match[1]), port: parseInt(match[2]) };
+}
+
+function isTunnelAddress(address) {
+  return address.startsWith('ssh://') || address.startsWith('vsock://');
+}
+
+// Node cannot dial these transports itself, so they are forwarded to a local socket by a helper process that is
+// restarted when it exits, so the tunnel survives network hiccups and machine restarts.
+class Tunnel {
+  constructor(address) {
+    this.address = address;
+    this.dir = fs.mkdtempSync(path.join(os.tmpdir(), 'podman-wsl-service-tunnel-'));
+    this.socketPath = path.join(this.dir, 'podman.sock');
+    this.process = null;
+    this.restartTimer = null;
+    this.stopped = false;
+  }
+
+  start() {
+    this.spawn();
+  }
+
+  spawn() {
+    const [command, args] = this.getCommand();
+    console.log(`Opening tunnel to ${this.address} on ${this.socketPath}`);
+    let stderr = '';
+    this.process = spawn(command, args, { stdio: ['ignore', 'ignore', 'pipe'] });
+    this.process.stderr.on('data', (chunk) => (stderr += chunk));
+    this.process.on('error', (err) => console.error(`Unable to run ${command} for ${this.address}: ${err.message}`));
+    this.process.on('close', (code) => {
+      this.process = null;
+      if (this.stopped) {
+        return;
+      }
+      console.error(`Tunnel to ${this.address} exited with code ${code}: ${stderr.trim()}`);
+      this.restartTimer = setTimeout(() => this.spawn(), 5000);
+    });
+  }
+
+  stop() {
+    this.stopped = true;
+    clearTimeout(this.restartTimer);
+    if (this.process) {
+      this.process.kill();
+    }
+    fs.rmSync(this.dir, { recursive: true, force: true });
+  }
+}
+
+// Forwards the local socket to the podman socket on a remote host with `ssh -L`
+class SshTunnel extends Tunnel {
+  constructor(address, identityFile = null) {
+    super(address);
+    this.target = parseSshAddress(address);
+    this.identityFile = identityFile;
+  }
+
+  getCommand() {
+    const { user, host, port, remotePath } = this.target;
+    const args = [
+      '-N',
+      '-o',
+      'BatchMode=yes',
+      '-o',
+      'ExitOnForwardFailure=yes',
+      '-o',
+      'StreamLocalBindUnlink=yes',
+      '-o',
+      'ServerAliveInterval=15',
+      '-L',
+      `${this.socketPath}:${remotePath}`,
+    ];
+    if (port) {
+      args.push('-p', String(port));
+    }
+    if (this.identityFile) {
+      args.push('-i', this.identityFile);
+    }
+    args.push(user ? `${user}@${host}` : host);
+    return ['ssh', args];
+  }
+}
+
+// Forwards the local socket to a vsock listener with socat, opening a new vsock connection per client connection
+class VsockTunnel extends Tunnel {
+  constructor(address) {
+    super(address);
+    this.target = parseVsockAddress(address);
+  }
+
+  getCommand() {
+    const { cid, port } = this.target;
+    return ['socat', [`UNIX-LISTEN:${this.socketPath},fork,unlink-early`, `VSOCK-CONNECT:${cid}:${port}`]];
+  }
+}
+
+function parseTunnelAddress(address) {
+  return address.startsWith('ssh://') ? parseSshAddress(address) : parseVsockAddress(address);
+}
+
+function createTunnel(address, { sshIdentity = null } = {}) {
+  return address.startsWith('ssh://') ? new SshTunnel(address, sshIdentity) : new VsockTunnel(address);
+}
+
+module.exports = { isTunnelAddress, parseTunnelAddress, createTunnel, SshTunnel, VsockTunnel };
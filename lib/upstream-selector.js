@@ -0,0 +1,187 @@
+const fs = require('fs');
+const path = require('path');
+const { EventEmitter } = require('events');
+const { parseUpstreamAddress, pingUpstream } = require('./upstream');
+
+// Keeps track of which of the configured upstream sockets to use. Sockets are preferred in the order given; the first
+// one answering a ping becomes active, and a failed socket is replaced by the next live one. When none of them answers,
+// the upstream is marked unavailable until a later check succeeds, e.g. after the machine was restarted.
+//
+// The overall state is "healthy" when all sockets answer, "degraded" when only some of them do and "down" when none do.
+// Until the first check it is "unknown", which counts as available. A "change" event is emitted when the state or the
+// active socket changes.
+class UpstreamSelector extends EventEmitter {
+  constructor(socketPaths, checkInterval) {
+    super();
+    this.socketPaths = socketPaths;
+    this.checkInterval = checkInterval;
+    this.activeSocketPath = socketPaths[0];
+    this.state = 'unknown';
+    this.stateSince = new Date();
+    this.lastCheck = null;
+    this.sockets = socketPaths.map((socketPath) => ({ path: socketPath, healthy: null }));
+    this.checking = null;
+    this.timer = null;
+  }
+
+  get active() {
+    return this.activeSocketPath;
+  }
+
+  get available() {
+    return this.state !== 'down';
+  }
+
+  getHealth() {
+    return {
+      state: this.state,
+      since: this.stateSince.toISOString(),
+      lastCheck: this.lastCheck && this.lastCheck.toISOString(),
+      active: this.activeSocketPath,
+      sockets: this.sockets,
+    };
+  }
+
+  start() {
+    if (this.checkInterval <= 0) {
+      return;
+    }
+    this.check();
+    this.timer = setInterval(() => this.check(), this.checkInterval * 1000);
+    this.timer.unref();
+  }
+
+  stop() {
+    clearInterval(this.timer);
+    this.timer = null;
+  }
+
+  // Concurrent callers share the same check
+  check() {
+    if (!this.checking) {
+      this.checking = this.selectLive().finally(() => {
+        this.checking = null;
+      });
+    }
+    return this.checking;
+  }
+
+  // Pings all sockets at once, so the state of the standby sockets is known as well
+  async selectLive() {
+    this.sockets = await Promise.all(
+      this.socketPaths.map(async (socketPath) => {
+        const started = Date.now();
+        try {
+          await pingUpstream(socketPath, 2000);
+          return { path: socketPath, healthy: true, latency: Date.now() - started };
+        } catch (err) {
+          console.debug(`Upstream socket ${socketPath} is not available: ${err.message}`);
+          return { path: socketPath, healthy: false, error: err.message };
+        }
+      })
+    );
+    this.lastCheck = new Date();
+
+    const live = this.sockets.find((socket) => socket.healthy);
+    if (live) {
+      this.setActive(live.path);
+    }
+    this.setState(!live ? 'down' : this.sockets.every((socket) => socket.healthy) ? 'healthy' : 'degraded');
+  }
+
+  setState(state) {
+    if (state === this.state) {
+      return;
+    }
+    const message = `Upstream state changed from ${this.state} to ${state}`;
+    if (state === 'down') {
+      console.error(`${message}: no upstream socket is available`);
+    } else {
+      console.log(message);
+    }
+    this.state = state;
+    this.stateSince = new Date();
+    this.emit('change');
+  }
+
+  // Re-checks an unavailable upstream right away, so clients do not have to wait for the next interval after the
+  // machine came back. A missing socket file means the machine went away, so that is noticed before a request fails.
+  async ensureAvailable() {
+    if (!this.available || !this.activeSocketExists()) {
+      await this.check();
+    }
+    return this.available;
+  }
+
+  activeSocketExists() {
+    const { socketPath } = parseUpstreamAddress(this.activeSocketPath);
+    return !socketPath || fs.existsSync(socketPath);
+  }
+
+  setActive(socketPath) {
+    if (socketPath !== this.activeSocketPath) {
+      console.log(`Switching upstream socket from ${this.activeSocketPath} to ${socketPath}`);
+      this.activeSocketPath = socketPath;
+      this.emit('change');
+    }
+  }
+
+  // Pings the sockets with backoff until one of them answers. Socket files usually appear when the machine comes up, so
+  // changes in their directories cut the wait short. A timeout of 0 waits forever.
+  async waitForLive(timeout) {
+    const deadline = timeout > 0 ? Date.now() + timeout * 1000 : Infinity;
+    let delay = 500;
+    let attempt = 0;
+    for (;;) {
+      await this.check();
+      if (this.available) {
+        return;
+      }
+      const lastError = this.sockets[0].error;
+      if (Date.now() >= deadline) {
+        throw new Error(`no upstream socket answered within ${timeout} seconds: ${lastError}`);
+      }
+      // Only the first attempt is logged at info level to avoid flooding the journal during long waits
+      const message = `Waiting for the upstream socket: ${lastError}`;
+      if (attempt++ === 0) {
+        console.log(message);
+      } else {
+        console.debug(message);
+      }
+      await this.waitForSocketChange(Math.min(delay, deadline - Date.now()));
+      delay = Math.min(delay * 2, 10000);
+    }
+  }
+
+  waitForSocketChange(timeout) {
+    return new Promise((resolve) => {
+      const watchers = [];
+      const done = () => {
+        clearTimeout(timer);
+        watchers.forEach((watcher) => watcher.close());
+        resolve();
+      };
+      const timer = setTimeout(done, timeout);
+      for (const socketPath of this.socketPaths) {
+        const { socketPath: filePath } = parseUpstreamAddress(socketPath);
+        if (!filePath) {
+          continue;
+        }
+        try {
+          watchers.push(fs.watch(path.dirname(filePath), done));
+        } catch (err) {
+          // The directory does not exist yet, rely on the timer
+        }
+      }
+    });
+  }
+
+  // Called when a request to the given socket failed to connect
+  reportFailure(socketPath) {
+    if (socketPath === this.activeSocketPath) {
+      this.check();
+    }
+  }
+}
+
+module.exports = { UpstreamSelector };
@@ -0,0 +1,121 @@
+const http = require('http');
+const net = require('net');
+
+// Connections to the upstream are kept open and reused between requests. Upgraded connections bypass the pool.
+const upstreamAgent = new http.Agent({ keepAlive: true, maxFreeSockets: 16 });
+
+// Connection-specific headers, which must not be copied between the client and upstream connections
+const hopByHopHeaders = ['connection', 'keep-alive', 'proxy-connection', 'te', 'trailer', 'upgrade'];
+
+// Parses an upstream address (a socket path, unix:///path or tcp://host:port) into http.request options
+function parseUpstreamAddress(address) {
+  if (address.startsWith('unix://')) {
+    return { socketPath: address.slice('unix://'.length) };
+  }
+  if (address.startsWith('tcp://')) {
+    let url;
+    try {
+      url = new URL(address);
+    } catch (err) {
+      throw new Error(`invalid upstream address ${address}`);
+    }
+    if (!url.hostname || !url.port || (url.pathname && url.pathname !== '/')) {
+      throw new Error(`invalid upstream address ${address}, expected tcp://host:port`);
+    }
+    return { host: url.hostname.replace(/^\[(.*)\]$/, '$1'), port: parseInt(url.port) };
+  }
+  if (/^[a-z][a-z0-9+.-]*:\/\//i.test(address)) {
+    throw new Error(`unsupported upstream address ${address}`);
+  }
+  return { socketPath: address };
+}
+
+// Fails connections to the upstream that are not established in time, instead of leaving clients hanging while the
+// machine is restarting. Established connections can be idle for a long time (e.g. while following logs).
+function setConnectTimeout(socket, timeout = 5000) {
+  if (!socket.connecting) {
+    return;
+  }
+  const onTimeout = () => {
+    const err = new Error(`connecting to the upstream timed out after ${timeout / 1000} seconds`);
+    err.code = 'ETIMEDOUT';
+    socket.destroy(err);
+  };
+  socket.setTimeout(timeout);
+  socket.once('timeout', onTimeout);
+  socket.once('connect', () => {
+    socket.setTimeout(0);
+    socket.removeListener('timeout', onTimeout);
+  });
+}
+
+// Opens a raw connection to the upstream, used for upgraded connections. Half-open connections are allowed, so that
+// the end of one direction of an attach stream (e.g. stdin) does not end the other one.
+function connectUpstream(address, { highWaterMark, connectTimeout } = {}, callback) {
+  const { socketPath, host, port } = parseUpstreamAddress(address);
+  const options = socketPath ? { path: socketPath } : { host, port };
+  const socket = net.connect({ ...options, allowHalfOpen: true, highWaterMark }, callback);
+  setConnectTimeout(socket, connectTimeout);
+  return socket;
+}
+
+// Sends a request to the upstream API. The body may be a string, a buffer or a readable stream.
+function requestUpstream(address, method, apiPath, { body = null, headers = {}, timeout = 0 } = {}) {
+  return new Promise((resolve, reject) => {
+    const options = { ...parseUpstreamAddress(address), agent: upstreamAgent, method, path: apiPath, headers, timeout };
+    const req = http.request(options, (res) => {
+      const chunks = [];
+      res.on('data', (chunk) => chunks.push(chunk));
+      res.on('end', () =>
+        resolve({ statusCode: res.statusCode, headers: res.headers, body: Buffer.concat(chunks).toString() })
+      );
+      res.on('error', reject);
+    });
+    req.on('timeout', () => req.destroy(new Error(`${method} ${apiPath} timed out`)));
+    req.on('error', reject);
+
+    if (body && typeof body.pipe === 'function') {
+      body.on('error', (err) => req.destroy(err));
+      body.pipe(req);
+    } else {
+      req.end(body);
+    }
+  });
+}
+
+// Like requestUpstream, but parses the JSON response and fails on error status codes
+async function requestUpstreamJson(address, method, apiPath, body = null) {
+  const res = await requestUpstream(address, method, apiPath, {
+    body: body === null ? null : JSON.stringify(body),
+    headers: body === null ? {} : { 'Content-Type': 'application/json' },
+  });
+  let parsed = null;
+  try {
+    parsed = res.body ? JSON.parse(res.body) : null;
+  } catch (err) {
+    // Not JSON, handled below
+  }
+  if (res.statusCode >= 400) {
+    const message = parsed && parsed.message ? parsed.message : res.body;
+    throw new Error(`${method} ${apiPath} failed with status ${res.statusCode}: ${message}`);
+  }
+  return parsed;
+}
+
+async function pingUpstream(address, timeout) {
+  const res = await requestUpstream(address, 'GET', '/_ping', { timeout });
+  if (res.statusCode !== 200) {
+    throw new Error(`ping failed with status ${res.statusCode}`);
+  }
+}
+
+module.exports = {
+  upstreamAgent,
+  hopByHopHeaders,
+  parseUpstreamAddress,
+  setConnectTimeout,
+  connectUpstream,
+  requestUpstream,
+  requestUpstreamJson,
+  pingUpstream,
+};
@@ -0,0 +1,157 @@
+const fs = require('fs');
+const path = require('path');
+const { getUserGid } = require('./passwd');
+
+const userRuntimeDir = '/run/user';
+
+// Serves a socket at /run/user/<uid>/podman/podman.sock for every user with a runtime directory, matching the
+// location of podman's own rootless socket. Runtime directories come and go with user sessions, so the directory is
+// watched and rescanned periodically; the rescan also recreates sockets whose runtime directory was remounted.
+class UserSockets {
+  constructor(createServer, baseDir = userRuntimeDir) {
+    this.createServer = createServer;
+    this.baseDir = baseDir;
+    this.listeners = new Map();
+    this.watcher = null;
+    this.timer = null;
+    this.scanTimer = null;
+  }
+
+  start() {
+    this.scan();
+    try {
+      this.watcher = fs.watch(this.baseDir, () => this.scheduleScan());
+    } catch (err) {
+      console.error(`Unable to watch ${this.baseDir}: ${err.message}`);
+    }
+    this.timer = setInterval(() => this.scan(), 30000);
+    this.timer.unref();
+  }
+
+  stop() {
+    if (this.watcher) {
+      this.watcher.close();
+    }
+    clearInterval(this.timer);
+    clearTimeout(this.scanTimer);
+    for (const uid of [...this.listeners.keys()]) {
+      this.remove(uid);
+    }
+  }
+
+  // The runtime directory is usually mounted shortly after it is created, so give it a moment
+  scheduleScan() {
+    clearTimeout(this.scanTimer);
+    this.scanTimer = setTimeout(() => this.scan(), 1000);
+  }
+
+  scan() {
+    let uids;
+    try {
+      uids = fs
+        .readdirSync(this.baseDir)
+        .filter((name) => /^\d+$/.test(name))
+        .map(Number);
+    } catch (err) {
+      console.error(`Unable to list ${this.baseDir}: ${err.message}`);
+      return;
+    }
+
+    for (const uid of this.listeners.keys()) {
+      if (!uids.includes(uid) || !fs.existsSync(this.listeners.get(uid).socketPath)) {
+        this.remove(uid);
+      }
+    }
+    for (const uid of uids) {
+      if (!this.listeners.has(uid)) {
+        this.add(uid);
+      }
+    }
+  }
+
+  // The runtime directory belongs to the user, who could replace the socket directory with a symlink at any time,
+  // e.g. to /etc, to have it chowned to them. It is opened without following symlinks and only used through its file
+  // descriptor from then on, also for binding the socket.
+  add(uid) {
+    const runtimeDir = path.join(this.baseDir, String(uid));
+    const socketDir = path.join(runtimeDir, 'podman');
+    const socketPath = path.join(socketDir, 'podman.sock');
+    const gid = getUserGid(uid);
+    let fd;
+    try {
+      const runtimeStat = fs.lstatSync(runtimeDir);
+      if (!runtimeStat.isDirectory() || runtimeStat.uid !== uid) {
+        // noinspection ExceptionCaughtLocallyJS
+        throw new Error(`${runtimeDir} is not a directory owned by the user`);
+      }
+      try {
+        fs.mkdirSync(socketDir, { mode: 0o700 });
+      } catch (err) {
+        if (err.code !== 'EEXIST') {
+          // noinspection ExceptionCaughtLocallyJS
+          throw err;
+        }
+      }
+      try {
+        fd = fs.openSync(socketDir, fs.constants.O_RDONLY | fs.constants.O_DIRECTORY | fs.constants.O_NOFOLLOW);
+      } catch (err) {
+        // noinspection ExceptionCaughtLocallyJS
+        throw err.code === 'ELOOP' || err.code === 'ENOTDIR' ? new Error(`${socketDir} is not a directory`) : err;
+      }
+      fs.fchownSync(fd, uid, gid);
+      fs.fchmodSync(fd, 0o700);
+    } catch (err) {
+      if (fd !== undefined) {
+        fs.closeSync(fd);
+      }
+      console.error(`Unable to prepare the socket directory for user ${uid}: ${err.message}`);
+      return;
+    }
+
+    // Resolves to the directory that was opened, wherever it is moved
+    const fdSocketPath = path.join(`/proc/self/fd/${fd}`, 'podman.sock');
+    try {
+      fs.unlinkSync(fdSocketPath);
+    } catch (err) {
+      // There is no socket left behind
+    }
+    const server = this.createServer();
+    this.listeners.set(uid, { server, socketPath, fd, fdSocketPath });
+    server.on('error', (err) => {
+      console.error(`Error on the socket for user ${uid}: ${err.message}`);
+      this.remove(uid, false);
+    });
+    server.listen(fdSocketPath, () => {
+      // The directory is only accessible to the user, so the default mode of the socket is fine. lchown does not
+      // follow a symlink put in place of the socket in the meantime.
+      try {
+        fs.lchownSync(fdSocketPath, uid, gid);
+      } catch (err) {
+        console.error(`Unable to set the ownership of ${socketPath}: ${err.message}`);
+        this.remove(uid);
+        return;
+      }
+      console.log(`Listening on ${socketPath} for user ${uid}`);
+    });
+  }
+
+  remove(uid, log = true) {
+    const listener = this.listeners.get(uid);
+    if (!listener) {
+      return;
+    }
+    this.listeners.delete(uid);
+    listener.server.close();
+    try {
+      fs.unlinkSync(listener.fdSocketPath);
+    } catch (err) {
+      // The runtime directory is already gone
+    }
+    fs.closeSync(listener.fd);
+    if (log) {
+      console.log(`Closed the socket for user ${uid}`);
+    }
+  }
+}
+
+module.exports = { userRuntimeDir, UserSockets };
@@ -0,0 +1,62 @@
+const crypto = require('crypto');
+const fs = require('fs');
+const { spawn } = require('child_process');
+const { ProxyError } = require('./errors');
+const { requestUpstream, requestUpstreamJson } = require('./upstream');
+
+// Filesystems whose contents are not reachable from the machine through the shared root
+const unshareableFsTypes = /^(fuse(\..+|blk)?|nfs4?|cifs|smb3)$/;
+
+function isUnshareableFilesystem(fsType) {
+  return unshareableFsTypes.test(fsType);
+}
+
+function getVolumeName(prefix, distroName, hostPath) {
+  const hash = crypto.createHash('sha256').update(`${distroName}:${hostPath}`).digest('hex');
+  return `${prefix}-${hash.slice(0, 12)}`;
+}
+
+// Creates (or reuses) a named volume and streams a tarball of the directory into it through the libpod import API.
+// Files removed from the source since a previous copy are not removed from the volume.
+async function copyDirectoryToVolume(upstreamSocketPath, distroName, hostPath) {
+  if (!fs.statSync(hostPath).isDirectory()) {
+    throw new ProxyError(400, `cannot copy ${hostPath} into a volume: only directories are supported`);
+  }
+
+  const volumeName = getVolumeName('podman-wsl-copy', distroName, hostPath);
+  await requestUpstreamJson(upstreamSocketPath, 'POST', '/volumes/create', {
+    Name: volumeName,
+    Labels: { 'wsl.distro': distroName, 'wsl.source': hostPath },
+  });
+
+  const tar = spawn('tar', ['-C', hostPath, '-cf', '-', '.'], { stdio: ['ignore', 'pipe', 'pipe'] });
+  let tarError = '';
+  tar.stderr.on('data', (chunk) => (tarError += chunk));
+  const tarExit = new Promise((resolve) => tar.on('close', resolve));
+
+  const res = await requestUpstream(
+    upstreamSocketPath,
+    'POST',
+    `/libpod/volumes/${encodeURIComponent(volumeName)}/import`,
+    { body: tar.stdout, headers: { 'Content-Type': 'application/x-tar', 'Transfer-Encoding': 'chunked' } }
+  );
+  const exitCode = await tarExit;
+  if (exitCode !== 0) {
+    throw new Error(`tar exited with code ${exitCode}: ${tarError.trim()}`);
+  }
+  if (res.statusCode >= 400) {
+    throw new Error(`volume import failed with status ${res.statusCode}: ${res.body}`);
+  }
+  return volumeName;
+}
+
+async function createScratchVolume(upstreamSocketPath, distroName, hostPath) {
+  const volumeName = getVolumeName('podman-wsl-scratch', distroName, hostPath);
+  await requestUpstreamJson(upstreamSocketPath, 'POST', '/volumes/create', {
+    Name: volumeName,
+    Labels: { 'wsl.distro': distroName, 'wsl.source': hostPath },
+  });
+  return volumeName;
+}
+
+module.exports = { isUnshareableFilesystem, getVolumeName, copyDirectoryToVolume, createScratchVolume };
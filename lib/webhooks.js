@@ -0,0 +1,67 @@
+const http = require('http');
+const https = require('https');
+
+const webhookTimeout = 5;
+
+// Container endpoints the webhooks are told about, for successful responses only
+const lifecyclePatterns = [
+  { event: 'create', method: 'POST', pattern: /^(?:\/libpod)?\/containers\/create$/, statusCodes: [201] },
+  { event: 'start', method: 'POST', pattern: /^(?:\/libpod)?\/containers\/([^/]+)\/start$/, statusCodes: [204] },
+  { event: 'remove', method: 'DELETE', pattern: /^(?:\/libpod)?\/containers\/([^/]+)$/, statusCodes: [200, 204] },
+];
+
+// Returns the event and the container as named in the path, or null for other requests
+function getLifecycleEvent(method, pathWithoutVersion, statusCode) {
+  for (const { event, method: eventMethod, pattern, statusCodes } of lifecyclePatterns) {
+    const match = method === eventMethod && statusCodes.includes(statusCode) && pathWithoutVersion.match(pattern);
+    if (match) {
+      return { event, container: match[1] ? decodeURIComponent(match[1]) : null };
+    }
+  }
+  return null;
+}
+
+function compileWebhooks(urls) {
+  if (!Array.isArray(urls)) {
+    throw new Error('"webhooks" must be an array');
+  }
+  return urls.map((url) => {
+    let parsed;
+    try {
+      parsed = new URL(url);
+    } catch (err) {
+      throw new Error(`Invalid webhook URL: ${url}`);
+    }
+    if (parsed.protocol !== 'http:' && parsed.protocol !== 'https:') {
+      throw new Error(`Invalid webhook URL, expected http:// or https://: ${url}`);
+    }
+    return parsed;
+  });
+}
+
+// Delivery is best effort: failures are logged and not retried, and never hold up the API response
+function postWebhook(url, payload, userAgent) {
+  const body = JSON.stringify(payload);
+  const req = (url.protocol === 'https:' ? https : http).request(url, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json', 'Content-Length': Buffer.byteLength(body), 'User-Agent': userAgent },
+    timeout: webhookTimeout * 1000,
+  });
+  req.on('response', (res) => {
+    res.resume();
+    if (res.statusCode >= 300) {
+      console.error(`Webhook ${url.origin} answered the ${payload.event} event with status ${res.statusCode}`);
+    } else {
+      console.debug(`Webhook ${url.origin} notified of the ${payload.event} event`);
+    }
+  });
+  req.on('timeout', () => req.destroy(new Error(`no answer within ${webhookTimeout} seconds`)));
+  req.on('error', (err) => console.error(`Unable to notify webhook ${url.origin}: ${err.message}`));
+  req.end(body);
+}
+
+function notifyWebhooks(urls, payload, userAgent) {
+  urls.forEach((url) => postWebhook(url, payload, userAgent));
+}
+
+module.exports = { getLifecycleEvent, compileWebhooks, notifyWebhooks };
@@ -0,0 +1,32 @@
+const fs = require('fs');
+
+const wslConfPath = '/etc/wsl.conf';
+const defaultAutomountRoot = '/mnt/';
+
+// Returns the [automount] root setting of wsl.conf, the directory WSL mounts the Windows drives in, with a trailing
+// slash like WSL itself uses it
+function getAutomountRoot(confPath = wslConfPath) {
+  let text;
+  try {
+    text = fs.readFileSync(confPath, 'utf8');
+  } catch (err) {
+    return defaultAutomountRoot;
+  }
+  let section = null;
+  for (const rawLine of text.split('\n')) {
+    const line = rawLine.replace(/[#;].*$/, '').trim();
+    const sectionMatch = line.match(/^\[(.+)\]$/);
+    if (sectionMatch) {
+      section = sectionMatch[1].trim().toLowerCase();
+      continue;
+    }
+    const settingMatch = line.match(/^([^=]+)=(.*)$/);
+    if (section === 'automount' && settingMatch && settingMatch[1].trim().toLowerCase() === 'root') {
+      const root = settingMatch[2].trim().replace(/^"(.*)"$/, '$1');
+      return root.endsWith('/') ? root : `${root}/`;
+    }
+  }
+  return defaultAutomountRoot;
+}
+
+module.exports = { defaultAutomountRoot, getAutomountRoot };
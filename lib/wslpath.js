@@ -0,0 +1,142 @@
+const path = require('path');
+const { execFileSync } = require('child_process');
+const { readMountInfo, getMountForPath } = require('./mountinfo');
+const { getAutomountRoot } = require('./wsl-conf');
+
+const automountRoot = getAutomountRoot();
+
+// Windows drives are mounted with drvfs on WSL 1 and as 9p shares on WSL 2
+const windowsFsTypes = ['drvfs', '9p', 'virtiofs'];
+
+function isWindowsMount(mount) {
+  return windowsFsTypes.includes(mount.fsType);
+}
+
+// The source of a drive mount is its Windows root, e.g. C:\ or \\server\share for network drives. Where the source
+// does not tell (e.g. with virtiofs), drives mounted as <automount root>/<letter> are still recognized.
+function getWindowsRoot(mount) {
+  if (!windowsFsTypes.includes(mount.fsType)) {
+    return null;
+  }
+  const source = mount.source.replace(/\\+$/, '');
+  if (/^[A-Za-z]:$/.test(source) || /^\\\\[^\\]+\\[^\\]+/.test(source)) {
+    return source;
+  }
+  const drive = mount.mountPoint.startsWith(automountRoot) && mount.mountPoint.slice(automountRoot.length);
+  return drive && /^[a-z]$/i.test(drive) ? `${drive.toUpperCase()}:` : null;
+}
+
+// Translates a path like `wslpath -aw` does, but from the mount table instead of running wslpath for every bind mount.
+// Returns null for mounts it does not know how to translate, which are left to wslpath.
+function getWindowsPath(hostPath, distroName, mounts) {
+  const absolutePath = path.posix.resolve(hostPath);
+  const mount = getMountForPath(absolutePath, mounts);
+  if (!mount) {
+    return null;
+  }
+  const windowsRoot = getWindowsRoot(mount);
+  if (windowsRoot) {
+    const relativePath = path.posix.join(mount.root, path.posix.relative(mount.mountPoint, absolutePath));
+    return `${windowsRoot}${relativePath.replace(/\//g, '\\')}`;
+  }
+  if (windowsFsTypes.includes(mount.fsType)) {
+    return null;
+  }
+  return `\\\\wsl.localhost\\${distroName}${absolutePath.replace(/\//g, '\\')}`;
+}
+
+// Clients may send Windows paths themselves, often with forward slashes (e.g. C:/Users/me/project from a Compose
+// file). Returns the path in the form wslpath prints, or null for other paths.
+function parseWindowsDrivePath(hostPath) {
+  const match = hostPath.match(/^([A-Za-z]):(?:[\\/](.*))?$/);
+  if (!match) {
+    return null;
+  }
+  const parts = (match[2] || '').split(/[\\/]+/).filter(Boolean);
+  return `${match[1].toUpperCase()}:\\${parts.join('\\')}`;
+}
+
+// Where a drive path is found in the distro, if the drive is mounted under the automount root
+function getDrivePath(windowsPath) {
+  const [drive, ...parts] = windowsPath.split('\\').filter(Boolean);
+  return path.posix.join(automountRoot, drive.slice(0, 1).toLowerCase(), ...parts);
+}
+
+// Runs wslpath for several paths from a single shell instead of spawning a process per path. Paths that cannot be
+// translated are missing from the result.
+function runWslpath(hostPaths) {
+  const script = 'for p; do wslpath -aw "$p" 2>/dev/null || echo; done';
+  const lines = execFileSync('sh', ['-c', script, 'sh', ...hostPaths]).toString().split('\n');
+  return new Map(hostPaths.map((hostPath, i) => [hostPath, lines[i]]).filter(([, windowsPath]) => windowsPath));
+}
+
+// Translates a batch of paths, reading the mount table once and running wslpath once for the rest
+function translateAll(hostPaths, distroName, mounts = readMountInfo()) {
+  const translated = new Map();
+  const rest = [];
+  for (const hostPath of hostPaths) {
+    const windowsPath = getWindowsPath(hostPath, distroName, mounts);
+    if (windowsPath) {
+      translated.set(hostPath, windowsPath);
+    } else {
+      rest.push(hostPath);
+    }
+  }
+  if (rest.length) {
+    runWslpath(rest).forEach((windowsPath, hostPath) => translated.set(hostPath, windowsPath));
+  }
+  return translated;
+}
+
+// Remembers translated paths for a while, as Compose and test runs create containers with the same bind sources over
+// and over. The least recently used entries are dropped first once the cache is full.
+class PathCache {
+  constructor(ttl = 60, maxEntries = 1000) {
+    this.ttl = ttl;
+    this.maxEntries = maxEntries;
+    this.entries = new Map();
+    this.hits = 0;
+    this.misses = 0;
+  }
+
+  get(hostPath, translate) {
+    const entry = this.entries.get(hostPath);
+    this.entries.delete(hostPath);
+    if (entry && entry.expires > Date.now()) {
+      this.hits++;
+      this.entries.set(hostPath, entry);
+      return entry.value;
+    }
+    this.misses++;
+    const value = translate(hostPath);
+    this.set(hostPath, value);
+    return value;
+  }
+
+  has(hostPath) {
+    const entry = this.entries.get(hostPath);
+    return !!entry && entry.expires > Date.now();
+  }
+
+  set(hostPath, value) {
+    this.entries.delete(hostPath);
+    this.entries.set(hostPath, { value, expires: Date.now() + this.ttl * 1000 });
+    if (this.entries.size > this.maxEntries) {
+      this.entries.delete(this.entries.keys().next().value);
+    }
+  }
+
+  getStats() {
+    return { entries: this.entries.size, hits: this.hits, misses: this.misses };
+  }
+}
+
+module.exports = {
+  automountRoot,
+  isWindowsMount,
+  getWindowsPath,
+  parseWindowsDrivePath,
+  getDrivePath,
+  translateAll,
+  PathCache,
+};